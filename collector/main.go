@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/enrichman/gocoverkube/internal/collector"
+)
+
+func main() {
+	dir := flag.String("dir", "/tmp/coverage", "coverage directory")
+	addr := flag.String("addr", fmt.Sprintf(":%d", collector.Port), "listen address")
+	flag.Parse()
+
+	token := os.Getenv(collector.TokenEnvVar)
+	if token == "" {
+		log.Fatalf("%s env var not set\n", collector.TokenEnvVar)
+	}
+
+	srv := &http.Server{
+		Addr:              *addr,
+		Handler:           collector.NewServer(*dir, token).Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		log.Printf("Collector serving '%s' on %s\n", *dir, srv.Addr)
+
+		err := srv.ListenAndServe()
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("server error: %s\n", err)
+		}
+	}()
+
+	// wait for the quit signal
+	<-quit
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Fatalf("Collector shutdown failed: %v\n", err)
+	}
+}
@@ -1,56 +1,104 @@
 package cli
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
-	"github.com/spf13/viper"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
-	"k8s.io/client-go/tools/clientcmd"
 
 	gcmd "github.com/enrichman/gocoverkube/internal/cmd"
 )
 
-var Version = "0.0.0-dev"
-
 type RootCfg struct {
-	kubeconfig string
-	namespace  string
-	deployment string
-	pod        string
+	configFile  string
+	configFlags *genericclioptions.ConfigFlags
+	// namespace is the one of the '--namespace/-n' flag, or of the current kubeconfig context
+	namespace     string
+	deployment    string
+	pod           string
+	targets       []Target
+	timeout       time.Duration
+	waitForLock   time.Duration
+	skipPreflight bool
+	output        string
+	quiet         bool
+	verbosity     int
 
 	client *kubernetes.Clientset
 	config *rest.Config
 }
 
+// payloadAnnotation marks the commands that write their own payload to the standard output, i.e. the manifests of rbac
+const payloadAnnotation = "gocoverkube/payload"
+
+// Execute runs the root command with the context, that is cancelled when the command is interrupted.
+// If the command was interrupted the state of the resources it touched is reported.
+func Execute(ctx context.Context) error {
+	tracker := gcmd.NewResourceTracker()
+
+	cmd, err := NewRootCmd().ExecuteContextC(gcmd.WithResourceTracker(ctx, tracker))
+	if err != nil && ctx.Err() != nil {
+		tracker.Report(os.Stderr)
+	}
+
+	// the commands printing their own payload end without the final document, that would break it
+	if _, payload := cmd.Annotations[payloadAnnotation]; payload && err == nil {
+		return nil
+	}
+
+	finishCtx := cmd.Context()
+	if !gcmd.HasPrinter(finishCtx) {
+		finishCtx = gcmd.WithPrinter(finishCtx, earlyPrinter(cmd))
+	}
+	gcmd.Finish(finishCtx, cmd.CommandPath(), err)
+
+	return err
+}
+
+// earlyPrinter returns the printer of the output flags for a command that failed before setting it up,
+// i.e. with an invalid flag, reading the environment variables that were not bound yet
+func earlyPrinter(cmd *cobra.Command) *gcmd.Printer {
+	output, _ := cmd.Flags().GetString("output")
+	if f := cmd.Flags().Lookup("output"); (f == nil || !f.Changed) && os.Getenv("OUTPUT") != "" {
+		output = os.Getenv("OUTPUT")
+	}
+	quiet, _ := cmd.Flags().GetBool("quiet")
+
+	printer, err := gcmd.NewPrinter(output, quiet)
+	if err != nil {
+		printer, _ = gcmd.NewPrinter(gcmd.OutputText, quiet)
+	}
+	return printer
+}
+
 func NewRootCmd() *cobra.Command {
 	rootCfg := &RootCfg{
-		kubeconfig: filepath.Join(os.Getenv("HOME"), ".kube", "config"),
-		namespace:  v1.NamespaceDefault,
+		configFlags: genericclioptions.NewConfigFlags(true),
+		timeout:     5 * time.Minute,
+		output:      gcmd.OutputText,
 	}
 
 	rootCmd := &cobra.Command{
 		Use:   "gocoverkube",
 		Short: "gocoverkube",
 		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
-			err := initializeConfig(cmd)
-			if err != nil {
-				return err
-			}
-
-			err = validateConfig(rootCfg)
+			err := rootCfg.setup(cmd)
 			if err != nil {
 				return err
 			}
 
-			clientset, config, err := newKubernetesClient(rootCfg.kubeconfig)
+			clientset, config, err := newKubernetesClient(rootCfg.configFlags)
 			if err != nil {
 				return err
 			}
@@ -60,7 +108,7 @@ func NewRootCmd() *cobra.Command {
 
 			_, err = gcmd.ServerVersion(clientset)
 			if err != nil {
-				return errors.New("error connecting to cluster")
+				return fmt.Errorf("error connecting to cluster, run 'gocoverkube doctor' for the details: %w", err)
 			}
 
 			return nil
@@ -71,19 +119,44 @@ func NewRootCmd() *cobra.Command {
 		NewInitCmd(rootCfg),
 		NewCollectCmd(rootCfg),
 		NewClearCmd(rootCfg),
+		NewForceUnlockCmd(rootCfg),
+		NewGCCmd(rootCfg),
+		NewRBACCmd(rootCfg),
+		NewDoctorCmd(rootCfg),
+		NewBuildCmd(rootCfg),
+		NewReportCmd(rootCfg),
 		NewVersionCmd(),
 	)
 
-	rootCmd.PersistentFlags().StringVar(&rootCfg.kubeconfig, "kubeconfig", rootCfg.kubeconfig, "kubeconfig [KUBECONFIG]")
-	rootCmd.PersistentFlags().StringVarP(&rootCfg.namespace, "namespace", "n", rootCfg.namespace, "namespace [NAMESPACE]")
+	rootCmd.PersistentFlags().StringVar(&rootCfg.configFile, "config", rootCfg.configFile, "config file, by default '.gocoverkube.yaml' in the current directory or 'gocoverkube/config.yaml' in the user config directory, i.e. $XDG_CONFIG_HOME [CONFIG]")
+	rootCmd.PersistentFlags().AddFlagSet(kubernetesFlags(rootCfg.configFlags))
 	rootCmd.PersistentFlags().StringVarP(&rootCfg.deployment, "deployment", "d", rootCfg.deployment, "deployment (DEPLOYMENT)")
 	rootCmd.PersistentFlags().StringVarP(&rootCfg.pod, "pod", "p", rootCfg.pod, "pod (POD)")
+	rootCmd.PersistentFlags().DurationVar(&rootCfg.timeout, "timeout", rootCfg.timeout, "maximum time to wait for the resources during the command, or during each collection in watch mode, 0 to wait forever [TIMEOUT]")
+	rootCmd.PersistentFlags().DurationVar(&rootCfg.waitForLock, "wait-for-lock", rootCfg.waitForLock, "maximum time to wait for the namespace lock held by another invocation [WAIT_FOR_LOCK]")
+	rootCmd.PersistentFlags().BoolVar(&rootCfg.skipPreflight, "skip-preflight", rootCfg.skipPreflight, "don't check the permissions of the command before changing anything [SKIP_PREFLIGHT]")
+	rootCmd.PersistentFlags().StringVar(&rootCfg.output, "output", rootCfg.output, "output format, 'text' or 'json' with one event per line, rbac and version print only their payload [OUTPUT]")
+	rootCmd.PersistentFlags().CountVarP(&rootCfg.verbosity, "verbose", "v", "log to stderr, repeat up to -vvv to log the pod states, the wait loops and the Kubernetes requests [VERBOSE]")
+	rootCmd.PersistentFlags().BoolVarP(&rootCfg.quiet, "quiet", "q", rootCfg.quiet, "print only the errors, and the final result in json output [QUIET]")
 
 	return rootCmd
 }
 
 func NewInitCmd(rootCfg *RootCfg) *cobra.Command {
-	return &cobra.Command{
+	collectorCfg := NewCollectorCfg()
+	defaults := gcmd.DefaultInitOptions()
+
+	var (
+		container       string
+		image           string
+		imageTagSuffix  string
+		storageClass    = defaults.Storage.Class
+		storageSize     = defaults.Storage.Size.String()
+		waitForCoverage = time.Minute
+		forceConflicts  bool
+	)
+
+	initCmd := &cobra.Command{
 		Use:           "init",
 		Short:         "init",
 		SilenceErrors: true,
@@ -91,27 +164,92 @@ func NewInitCmd(rootCfg *RootCfg) *cobra.Command {
 		RunE: func(cmd *cobra.Command, args []string) error {
 			cmd.SilenceUsage = true
 
-			if rootCfg.pod != "" {
-				return gcmd.InitPod(
-					cmd.Context(),
-					rootCfg.client,
-					rootCfg.namespace,
-					rootCfg.pod,
-				)
+			targets, err := rootCfg.Targets()
+			if err != nil {
+				return err
+			}
+
+			permissions := targetPermissions(targets)
+			permissions.StorageClass = storageClass != ""
+			err = preflight(cmd, rootCfg, permissions, namespaces(targets))
+			if err != nil {
+				return err
+			}
+
+			opts := defaults
+			opts.Collector, err = collectorCfg.Options()
+			if err != nil {
+				return err
+			}
+
+			opts.Image = gcmd.ImageOptions{Image: image, TagSuffix: imageTagSuffix}
+			opts.ForceConflicts = forceConflicts
+			opts.Storage.Class = storageClass
+			opts.Storage.Size, err = resource.ParseQuantity(storageSize)
+			if err != nil {
+				return fmt.Errorf("invalid storage size '%s': %w", storageSize, err)
 			}
 
-			return gcmd.InitDeployment(
-				cmd.Context(),
-				rootCfg.client,
-				rootCfg.namespace,
-				rootCfg.deployment,
-			)
+			for _, target := range targets {
+				opts.Container = container
+				if target.Container != "" {
+					opts.Container = target.Container
+				}
+
+				err := withLock(cmd.Context(), rootCfg, target.Namespace, func(ctx context.Context) error {
+					// the meta-data already on the shared volume is not written by the binary of the target
+					var before map[string]bool
+					if waitForCoverage != 0 {
+						before = gcmd.ListCoverageMeta(ctx, rootCfg.client, rootCfg.config, target.Namespace)
+					}
+
+					var err error
+					if target.Pod != "" {
+						err = gcmd.InitPod(ctx, rootCfg.client, target.Namespace, target.Pod, opts)
+					} else {
+						err = gcmd.InitDeployment(ctx, rootCfg.client, target.Namespace, target.Deployment, opts)
+					}
+					if err != nil || waitForCoverage == 0 {
+						return err
+					}
+
+					return gcmd.WaitForCoverageMeta(ctx, rootCfg.client, rootCfg.config, target.Namespace, waitForCoverage, before)
+				})
+				if err != nil {
+					return fmt.Errorf("%s: %w", target, err)
+				}
+			}
+
+			return nil
 		},
 	}
+
+	initCmd.Flags().StringVarP(&container, "container", "c", container, "container to instrument, the first one if not specified [CONTAINER]")
+	initCmd.Flags().StringVar(&storageClass, "storage-class", storageClass, "storage class of the coverage volume, the default one if not specified [STORAGE_CLASS]")
+	initCmd.Flags().StringVar(&storageSize, "storage-size", storageSize, "size of the coverage volume [STORAGE_SIZE]")
+	initCmd.Flags().StringVar(&image, "image", image, "instrumented image replacing the one of the container, restored by clear [IMAGE]")
+	initCmd.Flags().StringVar(&imageTagSuffix, "image-tag-suffix", imageTagSuffix, "suffix added to the tag of the image of the container to get the instrumented one, i.e. '-cover' [IMAGE_TAG_SUFFIX]")
+	initCmd.MarkFlagsMutuallyExclusive("image", "image-tag-suffix")
+	initCmd.Flags().BoolVar(&forceConflicts, "force-conflicts", forceConflicts, "take over the fields of the deployment owned by other managers, i.e. an existing GOCOVERDIR env var [FORCE_CONFLICTS]")
+	initCmd.Flags().DurationVar(&waitForCoverage, "wait-for-coverage", waitForCoverage, "maximum time to wait for the coverage meta-data written by the binary when it starts, 0 to not check it [WAIT_FOR_COVERAGE]")
+	collectorCfg.AddFlags(initCmd.Flags())
+
+	return initCmd
 }
 
 func NewCollectCmd(rootCfg *RootCfg) *cobra.Command {
-	return &cobra.Command{
+	copyOpts := gcmd.DefaultCopyOptions()
+	pathMap := gcmd.DefaultPathMapOptions()
+
+	var (
+		watch    bool
+		interval = 5 * time.Minute
+		restart  = true
+		debugLog bool
+		profile  string
+	)
+
+	collectCmd := &cobra.Command{
 		Use:           "collect",
 		Short:         "collect",
 		SilenceErrors: true,
@@ -119,33 +257,121 @@ func NewCollectCmd(rootCfg *RootCfg) *cobra.Command {
 		RunE: func(cmd *cobra.Command, args []string) error {
 			cmd.SilenceUsage = true
 
+			targets, err := rootCfg.Targets()
+			if err != nil {
+				return err
+			}
+
+			// the archive of each namespace would overwrite the previous one
+			if copyOpts.Archive && len(namespaces(targets)) > 1 {
+				return errors.New("'--archive' downloads a single archive, the targets need to be in the same namespace")
+			}
+
+			// in watch mode the workload is restarted at every interval, only if asked explicitly
+			if watch && !cmd.Flags().Changed("restart") {
+				restart = false
+			}
+
+			permissions := targetPermissions(targets)
+			permissions.Restart = restart
+			err = preflight(cmd, rootCfg, permissions, namespaces(targets))
+			if err != nil {
+				return err
+			}
+
 			outDir := args[0]
-			err := validateOutputDir(outDir)
+			err = validateOutputDir(outDir)
 			if err != nil {
 				return err
 			}
 
-			if rootCfg.pod != "" {
-				return gcmd.CollectPod(
-					cmd.Context(),
-					rootCfg.client,
-					rootCfg.config,
-					rootCfg.namespace,
-					rootCfg.pod,
-					outDir,
-				)
+			ctx := cmd.Context()
+			if debugLog {
+				logFile, err := os.Create(filepath.Join(outDir, gcmd.DebugLogFile))
+				if err != nil {
+					return fmt.Errorf("error creating debug log: %w", err)
+				}
+				defer logFile.Close()
+
+				ctx = gcmd.WithDebugLog(ctx, logFile)
+			}
+
+			// the targets of a namespace share the coverage volume, that is copied once after restarting all of them.
+			// The lock is acquired for every collection, to not block the namespace for the whole watch.
+			collect := func(ctx context.Context, outDst string) error {
+				if watch {
+					// the timeout is for each collection, not for the whole watch
+					ctx = gcmd.WithWaitTimeout(ctx, rootCfg.timeout)
+				}
+
+				for _, namespace := range namespaces(targets) {
+					err := withLock(ctx, rootCfg, namespace, func(ctx context.Context) error {
+						for _, target := range targets {
+							if !restart || target.Namespace != namespace {
+								continue
+							}
+
+							var err error
+							if target.Pod != "" {
+								err = gcmd.RestartPod(ctx, rootCfg.client, namespace, target.Pod)
+							} else {
+								err = gcmd.RestartDeployment(ctx, rootCfg.client, namespace, target.Deployment)
+							}
+							if err != nil {
+								return fmt.Errorf("%s: %w", target, err)
+							}
+						}
+
+						return gcmd.CollectFiles(ctx, rootCfg.client, rootCfg.config, namespace, outDst, copyOpts)
+					})
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+
+			if !watch {
+				err := collect(ctx, outDir)
+				if err != nil || profile == "" {
+					return err
+				}
+				return gcmd.WriteProfile(ctx, outDir, profile, pathMap)
 			}
 
-			return gcmd.Collect(
-				cmd.Context(),
-				rootCfg.client,
-				rootCfg.config,
-				rootCfg.namespace,
-				rootCfg.deployment,
-				outDir,
-			)
+			// only the new files are collected at every interval
+			copyOpts.Incremental = true
+
+			return gcmd.Watch(ctx, outDir, interval, pathMap, collect)
 		},
 	}
+
+	collectCmd.Flags().BoolVar(&copyOpts.Compress, "compress", copyOpts.Compress, "compress the files during the copy [COMPRESS]")
+	collectCmd.Flags().IntVar(&copyOpts.Retries, "retries", copyOpts.Retries, "retries for each file copy [RETRIES]")
+	collectCmd.Flags().BoolVar(&copyOpts.Archive, "archive", copyOpts.Archive, "download a single tar.gz archive of the coverage files [ARCHIVE]")
+	collectCmd.Flags().BoolVar(&copyOpts.Incremental, "incremental", copyOpts.Incremental, "copy only the coverage files not already collected in the output directory [INCREMENTAL]")
+	collectCmd.Flags().BoolVar(&copyOpts.Prune, "prune", copyOpts.Prune, "delete the coverage files from the volume once copied [PRUNE]")
+
+	collectCmd.Flags().BoolVar(&watch, "watch", watch, "collect, merge and report the coverage periodically, until interrupted [WATCH]")
+	collectCmd.Flags().DurationVar(&interval, "interval", interval, "interval between the collections in watch mode [INTERVAL]")
+	collectCmd.Flags().BoolVar(&restart, "restart", restart, "restart the workload to flush the coverage counters before collecting, by default not in watch mode [RESTART]")
+
+	collectCmd.Flags().StringVar(&profile, "report-profile", profile, "merge the collected coverage into this text profile, printing the coverage percentage [REPORT_PROFILE]")
+	addPathMapFlags(collectCmd.Flags(), &pathMap)
+	collectCmd.Flags().BoolVar(&debugLog, "debug-log", debugLog, "write a debug log with all the Kubernetes requests next to the collected coverage [DEBUG_LOG]")
+
+	collectCmd.MarkFlagsMutuallyExclusive("archive", "incremental")
+	collectCmd.MarkFlagsMutuallyExclusive("archive", "watch")
+	collectCmd.MarkFlagsMutuallyExclusive("archive", "report-profile")
+	collectCmd.MarkFlagsMutuallyExclusive("watch", "report-profile")
+
+	return collectCmd
+}
+
+// addPathMapFlags adds the flags mapping the import paths of the profiles to the local sources
+func addPathMapFlags(flags *pflag.FlagSet, pathMap *gcmd.PathMapOptions) {
+	flags.StringSliceVar(&pathMap.Mappings, "map", pathMap.Mappings, "map an import path of the profile to its local source directory, i.e. 'github.com/acme/svc=./services/svc' [MAP]")
+	flags.BoolVar(&pathMap.Detect, "map-detect", pathMap.Detect, "map the modules of the go.mod or go.work of the working directory, with their vendored and replaced modules [MAP_DETECT]")
 }
 
 func validateOutputDir(outDir string) error {
@@ -179,85 +405,365 @@ func NewClearCmd(rootCfg *RootCfg) *cobra.Command {
 		RunE: func(cmd *cobra.Command, args []string) error {
 			cmd.SilenceUsage = true
 
-			if rootCfg.pod != "" {
-				return gcmd.ClearPod(
-					cmd.Context(),
-					rootCfg.client,
-					rootCfg.namespace,
-					rootCfg.pod,
-				)
+			targets, err := rootCfg.Targets()
+			if err != nil {
+				return err
+			}
+
+			err = preflight(cmd, rootCfg, targetPermissions(targets), namespaces(targets))
+			if err != nil {
+				return err
+			}
+
+			for _, target := range targets {
+				err := withLock(cmd.Context(), rootCfg, target.Namespace, func(ctx context.Context) error {
+					if target.Pod != "" {
+						return gcmd.ClearPod(ctx, rootCfg.client, target.Namespace, target.Pod)
+					}
+					return gcmd.ClearDeployment(ctx, rootCfg.client, target.Namespace, target.Deployment)
+				})
+				if err != nil {
+					return fmt.Errorf("%s: %w", target, err)
+				}
+			}
+
+			return nil
+		},
+	}
+}
+
+func NewForceUnlockCmd(rootCfg *RootCfg) *cobra.Command {
+	return &cobra.Command{
+		Use:           "force-unlock",
+		Short:         "force-unlock",
+		SilenceErrors: true,
+		Args:          cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+
+			err := preflight(cmd, rootCfg, gcmd.PermissionOptions{}, []string{rootCfg.namespace})
+			if err != nil {
+				return err
+			}
+
+			return gcmd.ForceUnlock(cmd.Context(), rootCfg.client, rootCfg.namespace)
+		},
+	}
+}
+
+func NewGCCmd(rootCfg *RootCfg) *cobra.Command {
+	var dryRun bool
+
+	gcCmd := &cobra.Command{
+		Use:           "gc",
+		Short:         "gc",
+		Long:          "Delete the orphaned gocoverkube resources, in all the namespaces unless '--namespace/-n' is specified",
+		SilenceErrors: true,
+		Args:          cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+
+			namespace := v1.NamespaceAll
+			if cmd.Flags().Changed("namespace") {
+				namespace = rootCfg.namespace
+			}
+
+			err := preflight(cmd, rootCfg, gcmd.PermissionOptions{}, []string{namespace})
+			if err != nil {
+				return err
 			}
 
-			return gcmd.ClearDeployment(
-				cmd.Context(),
-				rootCfg.client,
-				rootCfg.namespace,
-				rootCfg.deployment,
-			)
+			return gcmd.GC(cmd.Context(), rootCfg.client, namespace, dryRun)
 		},
 	}
+
+	gcCmd.Flags().BoolVar(&dryRun, "dry-run", dryRun, "only print the resources that would be deleted [DRY_RUN]")
+
+	return gcCmd
 }
 
 func NewVersionCmd() *cobra.Command {
 	return &cobra.Command{
-		Use:   "version",
-		Short: "version",
-		Args:  cobra.NoArgs,
+		Use:         "version",
+		Short:       "version",
+		Args:        cobra.NoArgs,
+		Annotations: map[string]string{payloadAnnotation: "true"},
+		// the version doesn't need the cluster
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {},
 		Run: func(cmd *cobra.Command, args []string) {
-			fmt.Println(Version)
+			fmt.Println(gcmd.Version)
+		},
+	}
+}
+
+func NewRBACCmd(rootCfg *RootCfg) *cobra.Command {
+	var (
+		serviceAccount = "gocoverkube"
+		clusterWide    bool
+	)
+
+	rbacCmd := &cobra.Command{
+		Use:   "rbac [command...]",
+		Short: "rbac",
+		Long: fmt.Sprintf(
+			"Print the ServiceAccount, Role and RoleBinding manifests to run the commands in the namespace, i.e. from a Job. "+
+				"The commands are '%s', all of them if not specified.",
+			strings.Join(gcmd.RBACCommands(), "', '"),
+		),
+		SilenceErrors: true,
+		Annotations:   map[string]string{payloadAnnotation: "true"},
+		ValidArgs:     gcmd.RBACCommands(),
+		Args:          cobra.OnlyValidArgs,
+		// the manifests don't need the cluster
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			return rootCfg.setup(cmd)
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+
+			commands := args
+			if len(commands) == 0 {
+				commands = gcmd.RBACCommands()
+			}
+
+			return gcmd.WriteRBACManifests(cmd.OutOrStdout(), rootCfg.namespace, serviceAccount, commands, clusterWide)
+		},
+	}
+
+	rbacCmd.Flags().StringVar(&serviceAccount, "service-account", serviceAccount, "name of the ServiceAccount, and of its Role and RoleBinding [SERVICE_ACCOUNT]")
+	rbacCmd.Flags().BoolVar(&clusterWide, "cluster-wide", clusterWide, "grant the permissions in all the namespaces with a ClusterRole, i.e. to run gc without '--namespace/-n' [CLUSTER_WIDE]")
+
+	return rbacCmd
+}
+
+func NewDoctorCmd(rootCfg *RootCfg) *cobra.Command {
+	collectorCfg := NewCollectorCfg()
+
+	doctorCmd := &cobra.Command{
+		Use:           "doctor",
+		Short:         "doctor",
+		Long:          "Check the connection to the cluster, the storage classes, the Pod Security admission of the namespace, the instrumentation of the targets and the local go toolchain",
+		SilenceErrors: true,
+		Args:          cobra.NoArgs,
+		// the connection to the cluster is one of the checks
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			return rootCfg.setup(cmd)
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+
+			opts := gcmd.DoctorOptions{Namespace: rootCfg.namespace}
+
+			var err error
+			opts.Collector, err = collectorCfg.Options()
+			if err != nil {
+				return err
+			}
+
+			// the targets are optional, their binary is checked only if specified
+			if rootCfg.deployment != "" || rootCfg.pod != "" || len(rootCfg.targets) > 0 {
+				targets, err := rootCfg.Targets()
+				if err != nil {
+					return err
+				}
+				for _, t := range targets {
+					opts.Targets = append(opts.Targets, gcmd.DoctorTarget(t))
+				}
+			}
+
+			return gcmd.Doctor(cmd.Context(), func() (kubernetes.Interface, *rest.Config, error) {
+				return newKubernetesClient(rootCfg.configFlags)
+			}, opts)
+		},
+	}
+
+	collectorCfg.AddFlags(doctorCmd.Flags())
+
+	return doctorCmd
+}
+
+func NewBuildCmd(rootCfg *RootCfg) *cobra.Command {
+	opts := gcmd.DefaultBuildOptions()
+
+	buildCmd := &cobra.Command{
+		Use:           "build <main-package>",
+		Short:         "build",
+		Long:          "Build the main package with '-cover' and layer the binary onto the base image, without a Docker daemon",
+		SilenceErrors: true,
+		Args:          cobra.ExactArgs(1),
+		// the build doesn't need the cluster
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			return rootCfg.setup(cmd)
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+
+			opts.Main = args[0]
+			return gcmd.Build(cmd.Context(), opts)
 		},
 	}
+
+	buildCmd.Flags().StringVar(&opts.CoverPkg, "coverpkg", opts.CoverPkg, "packages whose coverage is recorded, as the '-coverpkg' flag of go build [COVERPKG]")
+	buildCmd.Flags().StringVar(&opts.Base, "base", opts.Base, "base image, or 'scratch' for an empty one [BASE]")
+	buildCmd.Flags().StringVar(&opts.Image, "image", opts.Image, "name of the image, '<binary>:cover' if not specified [IMAGE]")
+	buildCmd.Flags().StringVar(&opts.Platform, "platform", opts.Platform, "platform of the binary and of the base image, as 'os/arch[/variant]' [PLATFORM]")
+	buildCmd.Flags().BoolVar(&opts.Push, "push", opts.Push, "push the image to its registry [PUSH]")
+	buildCmd.Flags().StringVar(&opts.Tarball, "tarball", opts.Tarball, "write an archive loadable with 'docker load', 'k3d image import' or 'kind load image-archive' [TARBALL]")
+	buildCmd.Flags().StringVar(&opts.OCITarball, "oci-tarball", opts.OCITarball, "write the image as a tar of an OCI image layout, '<binary>.oci.tar' if no other output is specified [OCI_TARBALL]")
+
+	return buildCmd
 }
 
-func newKubernetesClient(kubeconfig string) (*kubernetes.Clientset, *rest.Config, error) {
-	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+func NewReportCmd(rootCfg *RootCfg) *cobra.Command {
+	reportCmd := &cobra.Command{
+		Use:   "report",
+		Short: "report",
+		Long:  "Report the coverage collected locally",
+		// the reports don't need the cluster
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			return rootCfg.setup(cmd)
+		},
+	}
+
+	reportCmd.AddCommand(NewReportMergeCmd())
+
+	return reportCmd
+}
+
+func NewReportMergeCmd() *cobra.Command {
+	pathMap := gcmd.DefaultPathMapOptions()
+	var outDir string
+
+	mergeCmd := &cobra.Command{
+		Use:           "merge <service-dir>...",
+		Short:         "merge",
+		Long:          "Merge the coverage collected from the binaries of different services into one profile, reporting which service covered each package and block. The service directories are the output directories of collect, also in watch mode",
+		SilenceErrors: true,
+		Args:          cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+
+			if outDir == "" {
+				return errors.New("the '--out-dir/-o' flag needs to be specified")
+			}
+
+			err := validateOutputDir(outDir)
+			if err != nil {
+				return err
+			}
+			return gcmd.MergeServices(cmd.Context(), outDir, args, pathMap)
+		},
+	}
+
+	mergeCmd.Flags().StringVarP(&outDir, "out-dir", "o", outDir, "directory of the merged coverage and of the reports [OUT_DIR]")
+	addPathMapFlags(mergeCmd.Flags(), &pathMap)
+
+	return mergeCmd
+}
+
+// setup reads the config file and the flags, and sets up the output and the namespace, without connecting to the cluster
+func (cfg *RootCfg) setup(cmd *cobra.Command) error {
+	err := initializeConfig(cmd, cfg)
 	if err != nil {
-		return nil, nil, err
+		return err
 	}
 
-	clientset, err := kubernetes.NewForConfig(config)
+	printer, err := gcmd.NewPrinter(cfg.output, cfg.quiet)
 	if err != nil {
-		return nil, nil, err
+		return err
 	}
+	cmd.SetContext(gcmd.WithPrinter(cmd.Context(), printer))
+	cmd.SetContext(gcmd.WithLogger(cmd.Context(), gcmd.NewLogger(os.Stderr, cfg.verbosity)))
+	cmd.SetContext(gcmd.WithWaitTimeout(cmd.Context(), cfg.timeout))
 
-	return clientset, config, nil
+	cfg.namespace, _, err = cfg.configFlags.ToRawKubeConfigLoader().Namespace()
+
+	return err
 }
 
-func initializeConfig(cmd *cobra.Command) error {
-	v := viper.New()
-	v.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
-	v.AutomaticEnv()
-	return bindFlags(cmd, v)
+// preflight checks the permissions needed by the command with the options in the namespaces, unless skipped
+func preflight(cmd *cobra.Command, rootCfg *RootCfg, opts gcmd.PermissionOptions, namespaces []string) error {
+	if rootCfg.skipPreflight {
+		return nil
+	}
+	return gcmd.Preflight(cmd.Context(), rootCfg.client, cmd.Name(), opts, namespaces)
 }
 
-// Bind each cobra flag to its associated viper configuration (config file and environment variable)
-func bindFlags(cmd *cobra.Command, v *viper.Viper) error {
-	var err error
+// targetPermissions returns the permission options of the kinds of the targets
+func targetPermissions(targets []Target) gcmd.PermissionOptions {
+	opts := gcmd.PermissionOptions{}
+	for _, t := range targets {
+		opts.Pods = opts.Pods || t.Pod != ""
+		opts.Deployments = opts.Deployments || t.Deployment != ""
+	}
+	return opts
+}
 
-	cmd.Flags().VisitAll(func(f *pflag.Flag) {
-		configName := f.Name
+// withLock runs the function holding the lock of the namespace, cancelling it if the lock is lost
+func withLock(ctx context.Context, rootCfg *RootCfg, namespace string, fn func(ctx context.Context) error) error {
+	lock, err := gcmd.AcquireLock(ctx, rootCfg.client, namespace, rootCfg.waitForLock)
+	if err != nil {
+		return err
+	}
 
-		// Apply the viper config value to the flag when the flag is not set and viper has a value
-		if !f.Changed && v.IsSet(configName) {
-			val := v.Get(configName)
-			setErr := cmd.Flags().Set(f.Name, fmt.Sprintf("%v", val))
-			if setErr != nil && err == nil {
-				err = setErr
-			}
+	err = fn(lock.Context())
+	if cause := context.Cause(lock.Context()); err != nil && ctx.Err() == nil && cause != nil {
+		err = cause
+	}
+
+	releaseErr := lock.Release(ctx)
+	if releaseErr != nil {
+		gcmd.Warn(ctx, "⚠️  Error releasing the lock on namespace '%s': %s", namespace, releaseErr)
+	}
+
+	return err
+}
+
+// kubernetesFlags returns the kubectl flags to select the kubeconfig, the context and the namespace, and to impersonate a user.
+// They can be set in the config file, but not with environment variables: names like 'user' or 'context' are too common.
+// The namespace keeps its NAMESPACE environment variable.
+func kubernetesFlags(configFlags *genericclioptions.ConfigFlags) *pflag.FlagSet {
+	flags := pflag.NewFlagSet("kubernetes", pflag.ContinueOnError)
+	configFlags.AddFlags(flags)
+
+	flags.VisitAll(func(f *pflag.Flag) {
+		if f.Name == "namespace" {
+			f.Usage += " [NAMESPACE]"
+			return
 		}
+		f.Annotations = map[string][]string{noEnvAnnotation: {"true"}}
 	})
 
-	return err
+	return flags
 }
 
-func validateConfig(cfg *RootCfg) error {
-	if cfg.pod == "" && cfg.deployment == "" {
-		return errors.New("one of '--deployment/-d' or '--pod/-p' flag needs to be specified")
+// newKubernetesClient loads the kubeconfig with the same rules of kubectl: the '--kubeconfig' flag,
+// the paths of the KUBECONFIG environment variable or the default one, and the context, cluster and user overrides.
+// Without a kubeconfig it uses the in-cluster config of the ServiceAccount of the Pod.
+func newKubernetesClient(configFlags *genericclioptions.ConfigFlags) (*kubernetes.Clientset, *rest.Config, error) {
+	rawConfig, err := configFlags.ToRawKubeConfigLoader().RawConfig()
+	if err != nil {
+		return nil, nil, err
 	}
 
-	if cfg.pod == "" && cfg.deployment == "" {
-		return errors.New("only one of '--deployment/-d' or '--pod/-p' flag needs to be specified")
+	// without a kubeconfig the loading rules fall back to the in-cluster config, or to localhost
+	if len(rawConfig.Clusters) == 0 && *configFlags.APIServer == "" {
+		_, err := rest.InClusterConfig()
+		if err != nil {
+			return nil, nil, fmt.Errorf("no kubeconfig found, and not running in a cluster: %w", err)
+		}
+	}
+
+	config, err := configFlags.ToRESTConfig()
+	if err != nil {
+		return nil, nil, err
 	}
+	config.Wrap(gcmd.LogRequests)
 
-	return nil
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return clientset, config, nil
 }
@@ -0,0 +1,82 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestExecutePayload(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		// wantPayload is in the output, that must have no final json document
+		wantPayload string
+		wantJSON    bool
+	}{
+		{
+			name:        "rbac",
+			args:        []string{"rbac", "collect", "--output", "json", "--namespace", "ns"},
+			wantPayload: "kind: Role",
+		},
+		{
+			name:        "version",
+			args:        []string{"version", "--output", "json"},
+			wantPayload: "",
+		},
+		{
+			name:     "invalid rbac command",
+			args:     []string{"rbac", "unknown", "--output", "json"},
+			wantJSON: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := captureStdout(t, func() {
+				os.Args = append([]string{"gocoverkube"}, tt.args...)
+				_ = Execute(context.Background())
+			})
+
+			if !strings.Contains(out, tt.wantPayload) {
+				t.Errorf("payload %q not in the output %q", tt.wantPayload, out)
+			}
+
+			lines := strings.Split(strings.TrimSpace(out), "\n")
+			last := map[string]any{}
+			isJSON := json.Unmarshal([]byte(lines[len(lines)-1]), &last) == nil && last["command"] != nil
+			if isJSON != tt.wantJSON {
+				t.Errorf("got final json document %v, want %v, output %q", isJSON, tt.wantJSON, out)
+			}
+		})
+	}
+}
+
+// captureStdout returns what f writes to the standard output
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, args := os.Stdout, os.Args
+	os.Stdout = w
+	t.Cleanup(func() { os.Stdout, os.Args = stdout, args })
+
+	done := make(chan []byte)
+	go func() {
+		var buf bytes.Buffer
+		_, _ = io.Copy(&buf, r)
+		done <- buf.Bytes()
+	}()
+
+	f()
+	os.Stdout = stdout
+	w.Close()
+	return string(<-done)
+}
@@ -0,0 +1,143 @@
+package cli
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/pflag"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	gcmd "github.com/enrichman/gocoverkube/internal/cmd"
+)
+
+type CollectorCfg struct {
+	image            string
+	command          []string
+	imagePullSecrets []string
+	cpuRequest       string
+	memoryRequest    string
+	cpuLimit         string
+	memoryLimit      string
+	tolerations      []string
+	nodeSelector     map[string]string
+
+	runAsUser              int64
+	runAsGroup             int64
+	fsGroup                int64
+	readOnlyRootFilesystem bool
+}
+
+func NewCollectorCfg() *CollectorCfg {
+	defaults := gcmd.DefaultCollectorOptions()
+
+	return &CollectorCfg{
+		image:                  defaults.Image,
+		cpuRequest:             defaults.Resources.Requests.Cpu().String(),
+		memoryRequest:          defaults.Resources.Requests.Memory().String(),
+		cpuLimit:               defaults.Resources.Limits.Cpu().String(),
+		memoryLimit:            defaults.Resources.Limits.Memory().String(),
+		nodeSelector:           map[string]string{},
+		runAsUser:              defaults.RunAsUser,
+		runAsGroup:             defaults.RunAsGroup,
+		fsGroup:                defaults.FSGroup,
+		readOnlyRootFilesystem: defaults.ReadOnlyRootFilesystem,
+	}
+}
+
+func (c *CollectorCfg) AddFlags(flags *pflag.FlagSet) {
+	flags.StringVar(&c.image, "collector-image", c.image, "collector image [COLLECTOR_IMAGE]")
+	flags.StringSliceVar(&c.command, "collector-command", c.command, "collector command, for images without the collector API [COLLECTOR_COMMAND]")
+	flags.StringSliceVar(&c.imagePullSecrets, "collector-image-pull-secret", c.imagePullSecrets, "collector image pull secrets [COLLECTOR_IMAGE_PULL_SECRET]")
+	flags.StringVar(&c.cpuRequest, "collector-cpu-request", c.cpuRequest, "collector CPU request [COLLECTOR_CPU_REQUEST]")
+	flags.StringVar(&c.memoryRequest, "collector-memory-request", c.memoryRequest, "collector memory request [COLLECTOR_MEMORY_REQUEST]")
+	flags.StringVar(&c.cpuLimit, "collector-cpu-limit", c.cpuLimit, "collector CPU limit [COLLECTOR_CPU_LIMIT]")
+	flags.StringVar(&c.memoryLimit, "collector-memory-limit", c.memoryLimit, "collector memory limit [COLLECTOR_MEMORY_LIMIT]")
+	flags.StringSliceVar(&c.tolerations, "collector-toleration", c.tolerations, "collector tolerations, as 'key[=value]:effect' [COLLECTOR_TOLERATION]")
+	flags.StringToStringVar(&c.nodeSelector, "collector-node-selector", c.nodeSelector, "collector node selector [COLLECTOR_NODE_SELECTOR]")
+	flags.Int64Var(&c.runAsUser, "collector-run-as-user", c.runAsUser, "collector user ID [COLLECTOR_RUN_AS_USER]")
+	flags.Int64Var(&c.runAsGroup, "collector-run-as-group", c.runAsGroup, "collector group ID [COLLECTOR_RUN_AS_GROUP]")
+	flags.Int64Var(&c.fsGroup, "collector-fs-group", c.fsGroup, "collector fsGroup [COLLECTOR_FS_GROUP]")
+	flags.BoolVar(&c.readOnlyRootFilesystem, "collector-read-only-root-fs", c.readOnlyRootFilesystem, "collector read-only root filesystem [COLLECTOR_READ_ONLY_ROOT_FS]")
+}
+
+func (c *CollectorCfg) Options() (gcmd.CollectorOptions, error) {
+	opts := gcmd.CollectorOptions{
+		Image:                  c.image,
+		Command:                c.command,
+		ImagePullSecrets:       c.imagePullSecrets,
+		NodeSelector:           c.nodeSelector,
+		RunAsUser:              c.runAsUser,
+		RunAsGroup:             c.runAsGroup,
+		FSGroup:                c.fsGroup,
+		ReadOnlyRootFilesystem: c.readOnlyRootFilesystem,
+		Resources: v1.ResourceRequirements{
+			Requests: v1.ResourceList{},
+			Limits:   v1.ResourceList{},
+		},
+	}
+
+	quantities := []struct {
+		flag  string
+		value string
+		list  v1.ResourceList
+		name  v1.ResourceName
+	}{
+		{"collector-cpu-request", c.cpuRequest, opts.Resources.Requests, v1.ResourceCPU},
+		{"collector-memory-request", c.memoryRequest, opts.Resources.Requests, v1.ResourceMemory},
+		{"collector-cpu-limit", c.cpuLimit, opts.Resources.Limits, v1.ResourceCPU},
+		{"collector-memory-limit", c.memoryLimit, opts.Resources.Limits, v1.ResourceMemory},
+	}
+
+	for _, q := range quantities {
+		// an empty value unsets the request/limit
+		if q.value == "" {
+			continue
+		}
+
+		quantity, err := resource.ParseQuantity(q.value)
+		if err != nil {
+			return opts, fmt.Errorf("invalid '--%s' value '%s': %w", q.flag, q.value, err)
+		}
+		q.list[q.name] = quantity
+	}
+
+	for _, t := range c.tolerations {
+		toleration, err := parseToleration(t)
+		if err != nil {
+			return opts, err
+		}
+		opts.Tolerations = append(opts.Tolerations, toleration)
+	}
+
+	return opts, nil
+}
+
+// parseToleration parses a toleration in the 'key[=value]:effect' format used by 'kubectl taint'.
+// An empty effect tolerates all the effects, and a missing value matches any value of the key.
+func parseToleration(s string) (v1.Toleration, error) {
+	keyValue, effect, found := strings.Cut(s, ":")
+	if !found {
+		return v1.Toleration{}, fmt.Errorf("invalid toleration '%s': expected 'key[=value]:effect'", s)
+	}
+
+	toleration := v1.Toleration{
+		Operator: v1.TolerationOpExists,
+		Effect:   v1.TaintEffect(effect),
+	}
+
+	key, value, hasValue := strings.Cut(keyValue, "=")
+	toleration.Key = key
+	if hasValue {
+		toleration.Operator = v1.TolerationOpEqual
+		toleration.Value = value
+	}
+
+	switch toleration.Effect {
+	case "", v1.TaintEffectNoSchedule, v1.TaintEffectPreferNoSchedule, v1.TaintEffectNoExecute:
+	default:
+		return v1.Toleration{}, fmt.Errorf("invalid toleration '%s': unknown effect '%s'", s, effect)
+	}
+
+	return toleration, nil
+}
@@ -0,0 +1,175 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// projectConfigFile is the config file of the project, in the current directory
+const projectConfigFile = ".gocoverkube.yaml"
+
+// noEnvAnnotation marks the flags that are not read from the environment variables
+const noEnvAnnotation = "gocoverkube/no-env"
+
+// Target is a workload to instrument, as described in the targets of the config file
+type Target struct {
+	Namespace  string `mapstructure:"namespace"`
+	Deployment string `mapstructure:"deployment"`
+	Pod        string `mapstructure:"pod"`
+	// Container is the container to instrument, the first one if empty
+	Container string `mapstructure:"container"`
+}
+
+func (t Target) String() string {
+	if t.Pod != "" {
+		return fmt.Sprintf("pod '%s/%s'", t.Namespace, t.Pod)
+	}
+	return fmt.Sprintf("deployment '%s/%s'", t.Namespace, t.Deployment)
+}
+
+// configPaths returns the paths of the config file, the one of the project and then the one of the user,
+// i.e. '$XDG_CONFIG_HOME/gocoverkube/config.yaml' on Linux
+func configPaths() []string {
+	paths := []string{projectConfigFile}
+	if configDir, err := os.UserConfigDir(); err == nil {
+		paths = append(paths, filepath.Join(configDir, "gocoverkube", "config.yaml"))
+	}
+	return paths
+}
+
+// findConfigFile returns the first of the paths that exists, or an empty string
+func findConfigFile(paths []string) string {
+	for _, p := range paths {
+		if info, err := os.Stat(p); err == nil && !info.IsDir() {
+			return p
+		}
+	}
+	return ""
+}
+
+func initializeConfig(cmd *cobra.Command, rootCfg *RootCfg) error {
+	v := viper.New()
+
+	// the config file is optional, unless explicitly set
+	configFile := rootCfg.configFile
+	if configFile == "" {
+		configFile = findConfigFile(configPaths())
+	}
+	if configFile != "" {
+		v.SetConfigFile(configFile)
+		err := v.ReadInConfig()
+		if err != nil {
+			return fmt.Errorf("error reading config file '%s': %w", configFile, err)
+		}
+	}
+
+	v.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
+	v.AutomaticEnv()
+
+	err := v.UnmarshalKey("targets", &rootCfg.targets)
+	if err != nil {
+		return fmt.Errorf("error reading targets from config file '%s': %w", v.ConfigFileUsed(), err)
+	}
+
+	return bindFlags(cmd, v)
+}
+
+// Bind each cobra flag to its associated viper configuration (config file and environment variable).
+// The flags with a prefix can be grouped in a section of the config file, i.e. 'collector-image' as 'image' in 'collector'.
+func bindFlags(cmd *cobra.Command, v *viper.Viper) error {
+	var err error
+
+	cmd.Flags().VisitAll(func(f *pflag.Flag) {
+		configName := f.Name
+		if section, key, found := strings.Cut(f.Name, "-"); found && !v.IsSet(configName) {
+			configName = section + "." + key
+		}
+		if _, noEnv := f.Annotations[noEnvAnnotation]; noEnv && !v.InConfig(configName) {
+			return
+		}
+
+		// Apply the viper config value to the flag when the flag is not set and viper has a value
+		if !f.Changed && v.IsSet(configName) {
+			setErr := setFlagValue(cmd.Flags(), f.Name, v.Get(configName))
+			if setErr != nil && err == nil {
+				err = setErr
+			}
+		}
+	})
+
+	return err
+}
+
+// setFlagValue sets a flag from a config value, handling the lists and maps of the config file
+func setFlagValue(flags *pflag.FlagSet, name string, val any) error {
+	switch val := val.(type) {
+	case []any:
+		// the first Set replaces the default value, the next ones append to it
+		for _, item := range val {
+			if err := flags.Set(name, fmt.Sprintf("%v", item)); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case map[string]any:
+		pairs := []string{}
+		for k, item := range val {
+			pairs = append(pairs, fmt.Sprintf("%s=%v", k, item))
+		}
+		return flags.Set(name, strings.Join(pairs, ","))
+	}
+
+	return flags.Set(name, fmt.Sprintf("%v", val))
+}
+
+// Targets returns the target of the '--deployment/-d' or '--pod/-p' flag, or the targets of the config file
+func (cfg *RootCfg) Targets() ([]Target, error) {
+	if cfg.pod != "" && cfg.deployment != "" {
+		return nil, errors.New("only one of '--deployment/-d' or '--pod/-p' flag needs to be specified")
+	}
+
+	targets := cfg.targets
+	if cfg.pod != "" || cfg.deployment != "" {
+		targets = []Target{{Deployment: cfg.deployment, Pod: cfg.pod}}
+	}
+
+	if len(targets) == 0 {
+		return nil, errors.New("one of '--deployment/-d' or '--pod/-p' flag, or the targets in the config file, needs to be specified")
+	}
+
+	for i, t := range targets {
+		if t.Pod == "" && t.Deployment == "" {
+			return nil, fmt.Errorf("target %d: one of 'deployment' or 'pod' needs to be specified", i+1)
+		}
+		if t.Pod != "" && t.Deployment != "" {
+			return nil, fmt.Errorf("target %d: only one of 'deployment' or 'pod' needs to be specified", i+1)
+		}
+
+		if t.Namespace == "" {
+			targets[i].Namespace = cfg.namespace
+		}
+	}
+
+	return targets, nil
+}
+
+// namespaces returns the namespaces of the targets, in order
+func namespaces(targets []Target) []string {
+	namespaces := []string{}
+	seen := map[string]bool{}
+	for _, t := range targets {
+		if !seen[t.Namespace] {
+			namespaces = append(namespaces, t.Namespace)
+			seen[t.Namespace] = true
+		}
+	}
+	return namespaces
+}
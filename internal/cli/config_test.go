@@ -0,0 +1,280 @@
+package cli
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+)
+
+func TestTargets(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     RootCfg
+		want    []Target
+		wantErr string
+	}{
+		{
+			name: "deployment flag",
+			cfg:  RootCfg{namespace: "ns", deployment: "app"},
+			want: []Target{{Namespace: "ns", Deployment: "app"}},
+		},
+		{
+			name: "pod flag overrides the config file",
+			cfg:  RootCfg{namespace: "ns", pod: "app", targets: []Target{{Deployment: "other"}}},
+			want: []Target{{Namespace: "ns", Pod: "app"}},
+		},
+		{
+			name: "config file targets with the default namespace",
+			cfg: RootCfg{namespace: "ns", targets: []Target{
+				{Deployment: "a", Container: "c"},
+				{Namespace: "other", Pod: "b"},
+			}},
+			want: []Target{
+				{Namespace: "ns", Deployment: "a", Container: "c"},
+				{Namespace: "other", Pod: "b"},
+			},
+		},
+		{
+			name:    "both flags",
+			cfg:     RootCfg{deployment: "a", pod: "b"},
+			wantErr: "only one of '--deployment/-d' or '--pod/-p'",
+		},
+		{
+			name:    "no targets",
+			cfg:     RootCfg{namespace: "ns"},
+			wantErr: "one of '--deployment/-d' or '--pod/-p' flag, or the targets",
+		},
+		{
+			name:    "target without workload",
+			cfg:     RootCfg{targets: []Target{{Deployment: "a"}, {Namespace: "ns"}}},
+			wantErr: "target 2: one of 'deployment' or 'pod'",
+		},
+		{
+			name:    "target with both workloads",
+			cfg:     RootCfg{targets: []Target{{Deployment: "a", Pod: "b"}}},
+			wantErr: "target 1: only one of 'deployment' or 'pod'",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.cfg.Targets()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNamespaces(t *testing.T) {
+	tests := []struct {
+		name    string
+		targets []Target
+		want    []string
+	}{
+		{name: "no targets", targets: nil, want: []string{}},
+		{
+			name:    "in order, without duplicates",
+			targets: []Target{{Namespace: "b"}, {Namespace: "a"}, {Namespace: "b"}},
+			want:    []string{"b", "a"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := namespaces(tt.targets)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBindFlags(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		env     map[string]string
+		args    []string
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name:   "section of the config file",
+			config: "collector:\n  image: from-section\n",
+			want:   map[string]string{"collector-image": "from-section"},
+		},
+		{
+			name:   "flat key of the config file",
+			config: "collector-image: from-key\n",
+			want:   map[string]string{"collector-image": "from-key"},
+		},
+		{
+			name: "environment variable",
+			env:  map[string]string{"COLLECTOR_IMAGE": "from-env"},
+			want: map[string]string{"collector-image": "from-env"},
+		},
+		{
+			name:   "flag overrides the config file",
+			config: "collector:\n  image: from-section\n",
+			args:   []string{"--collector-image", "from-flag"},
+			want:   map[string]string{"collector-image": "from-flag"},
+		},
+		{
+			name:   "list of the config file",
+			config: "map:\n  - a=./a\n  - b=./b\n",
+			want:   map[string]string{"map": "[a=./a,b=./b]"},
+		},
+		{
+			name: "no-env flag ignores the environment",
+			env:  map[string]string{"CONTEXT": "from-env"},
+			want: map[string]string{"context": ""},
+		},
+		{
+			name:   "no-env flag from the config file",
+			config: "context: from-config\n",
+			want:   map[string]string{"context": "from-config"},
+		},
+		{
+			name:    "invalid value",
+			config:  "retries: many\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, val := range tt.env {
+				t.Setenv(k, val)
+			}
+
+			cmd := &cobra.Command{Use: "test", RunE: func(*cobra.Command, []string) error { return nil }}
+			cmd.Flags().String("collector-image", "", "")
+			cmd.Flags().StringSlice("map", nil, "")
+			cmd.Flags().Int("retries", 0, "")
+			cmd.Flags().String("context", "", "")
+			_ = cmd.Flags().SetAnnotation("context", noEnvAnnotation, []string{"true"})
+			if err := cmd.Flags().Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+
+			v := viper.New()
+			v.SetConfigType("yaml")
+			if err := v.ReadConfig(strings.NewReader(tt.config)); err != nil {
+				t.Fatal(err)
+			}
+			v.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
+			v.AutomaticEnv()
+
+			err := bindFlags(cmd, v)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			for name, want := range tt.want {
+				if got := cmd.Flags().Lookup(name).Value.String(); got != want {
+					t.Errorf("flag '%s': got %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestKubernetesFlagsEnv(t *testing.T) {
+	flags := kubernetesFlags(genericclioptions.NewConfigFlags(true))
+
+	tests := []struct {
+		flag      string
+		wantNoEnv bool
+	}{
+		{flag: "namespace"},
+		{flag: "context", wantNoEnv: true},
+		{flag: "user", wantNoEnv: true},
+		{flag: "kubeconfig", wantNoEnv: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.flag, func(t *testing.T) {
+			_, noEnv := flags.Lookup(tt.flag).Annotations[noEnvAnnotation]
+			if noEnv != tt.wantNoEnv {
+				t.Errorf("flag '%s': got no-env %v, want %v", tt.flag, noEnv, tt.wantNoEnv)
+			}
+		})
+	}
+}
+
+func TestConfigPaths(t *testing.T) {
+	configHome := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", configHome)
+	userConfig := filepath.Join(configHome, "gocoverkube", "config.yaml")
+
+	paths := configPaths()
+	if want := []string{projectConfigFile, userConfig}; runtime.GOOS == "linux" && !reflect.DeepEqual(paths, want) {
+		t.Fatalf("got %v, want %v", paths, want)
+	}
+
+	project := filepath.Join(t.TempDir(), projectConfigFile)
+
+	tests := []struct {
+		name  string
+		files []string
+		want  string
+	}{
+		{
+			name: "no config file",
+		},
+		{
+			name:  "user config file",
+			files: []string{userConfig},
+			want:  userConfig,
+		},
+		{
+			name:  "project config file first",
+			files: []string{userConfig, project},
+			want:  project,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, f := range []string{userConfig, project} {
+				_ = os.Remove(f)
+			}
+			for _, f := range tt.files {
+				if err := os.MkdirAll(filepath.Dir(f), os.ModePerm); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(f, nil, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got := findConfigFile([]string{project, userConfig})
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,427 @@
+package cmd
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	ggcrv1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+const (
+	// BaseScratch is the empty base image
+	BaseScratch = "scratch"
+
+	// the labels of the built images
+	imageLabelPrefix   = "gocoverkube."
+	ImageLabelCoverPkg = imageLabelPrefix + "coverpkg"
+	ImageLabelMain     = imageLabelPrefix + "main"
+	ImageLabelModule   = imageLabelPrefix + "module"
+	ImageLabelGo       = imageLabelPrefix + "go-version"
+
+	// binDir is where the binary is copied in the image
+	binDir = "usr/local/bin"
+)
+
+// BuildOptions configures the build of a cover-instrumented image
+type BuildOptions struct {
+	// Main is the main package to build
+	Main string
+	// CoverPkg is the '-coverpkg' flag of go build, the packages whose coverage is recorded
+	CoverPkg string
+	// Base is the reference of the base image, or 'scratch'
+	Base string
+	// Image is the reference of the built image, '<binary>:cover' if empty
+	Image    string
+	Platform string
+
+	// Push pushes the image to the registry of its reference
+	Push bool
+	// Tarball is the path of an archive that can be loaded with 'docker load', 'k3d image import' or 'kind load image-archive'
+	Tarball string
+	// OCITarball is the path of the image as a tar of an OCI image layout, '<binary>.oci.tar' if there are no other outputs
+	OCITarball string
+}
+
+func DefaultBuildOptions() BuildOptions {
+	return BuildOptions{
+		CoverPkg: "./...",
+		Base:     BaseScratch,
+		Platform: "linux/" + runtime.GOARCH,
+	}
+}
+
+// goPackage is the output of 'go list' for the main package
+type goPackage struct {
+	name       string
+	importPath string
+	module     string
+}
+
+// Build builds the main package with '-cover' and layers the binary onto the base image, without a Docker daemon.
+// The image is pushed and written to the archives of the options, and labelled with the packages of the '-coverpkg' set.
+func Build(ctx context.Context, opts BuildOptions) error {
+	err := checkGoToolchain()
+	if err != nil {
+		return err
+	}
+
+	platform, err := ggcrv1.ParsePlatform(opts.Platform)
+	if err != nil {
+		return fmt.Errorf("invalid platform '%s': %w", opts.Platform, err)
+	}
+
+	pkg, err := listPackage(ctx, opts.Main)
+	if err != nil {
+		return err
+	}
+	if pkg.name != "main" {
+		return fmt.Errorf("package '%s' is not a main package", pkg.importPath)
+	}
+	binName := path.Base(pkg.importPath)
+
+	if opts.Image == "" {
+		opts.Image = binName + ":cover"
+	}
+	if !opts.Push && opts.Tarball == "" && opts.OCITarball == "" {
+		opts.OCITarball = binName + ".oci.tar"
+	}
+
+	ref, err := name.ParseReference(opts.Image)
+	if err != nil {
+		return fmt.Errorf("invalid image '%s': %w", opts.Image, err)
+	}
+
+	tmpDir, err := os.MkdirTemp("", "gocoverkube-build-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	binPath := filepath.Join(tmpDir, binName)
+	err = buildBinary(ctx, opts, platform, binPath)
+	if err != nil {
+		return err
+	}
+
+	base, err := baseImage(ctx, opts.Base, platform)
+	if err != nil {
+		return err
+	}
+
+	goVersion, err := goTool(ctx, nil, "env", "GOVERSION")
+	if err != nil {
+		return err
+	}
+
+	// the patterns are resolved, they depend on the working directory
+	coverPkgs, err := coverPackages(ctx, opts.CoverPkg, platform)
+	if err != nil {
+		return err
+	}
+
+	img, err := layerBinary(base, binPath, platform, map[string]string{
+		ImageLabelCoverPkg: strings.Join(coverPkgs, ","),
+		ImageLabelMain:     pkg.importPath,
+		ImageLabelModule:   pkg.module,
+		ImageLabelGo:       goVersion,
+	})
+	if err != nil {
+		return err
+	}
+
+	digest, err := img.Digest()
+	if err != nil {
+		return err
+	}
+	setResult(ctx, "image", ref.String())
+	setResult(ctx, "digest", digest.String())
+
+	if opts.OCITarball != "" {
+		err = writeOCITarball(opts.OCITarball, ref, img)
+		if err != nil {
+			return fmt.Errorf("error writing OCI image tarball: %w", err)
+		}
+		report(ctx, Event{Resource: fmt.Sprintf("Image '%s'", ref), Action: "write"}, "✅ OCI image tarball written at '%s'", opts.OCITarball)
+	}
+
+	if opts.Tarball != "" {
+		err = tarball.WriteToFile(opts.Tarball, ref, img)
+		if err != nil {
+			return fmt.Errorf("error writing image tarball: %w", err)
+		}
+		report(ctx, Event{Resource: fmt.Sprintf("Image '%s'", ref), Action: "write"}, "✅ Image archive written at '%s'", opts.Tarball)
+	}
+
+	if opts.Push {
+		s := newSpinner(ctx)
+		s.Suffix = " Pushing Image"
+		s.Start()
+
+		start := time.Now()
+		err = remote.Write(ref, img, remote.WithContext(ctx), remote.WithAuthFromKeychain(authn.DefaultKeychain))
+		s.Stop()
+		if err != nil {
+			return fmt.Errorf("error pushing image '%s': %w", ref, err)
+		}
+
+		elapsed := time.Since(start).Round(time.Second)
+		report(ctx, Event{Resource: fmt.Sprintf("Image '%s'", ref), Action: "push", Duration: elapsed},
+			"✅ Image pushed as '%s@%s' [%v]", ref.Context(), digest, elapsed)
+	}
+
+	return nil
+}
+
+func listPackage(ctx context.Context, main string) (goPackage, error) {
+	out, err := goTool(ctx, nil, "list", "-f", "{{.Name}} {{.ImportPath}} {{with .Module}}{{.Path}}{{end}}", main)
+	if err != nil {
+		return goPackage{}, err
+	}
+
+	fields := strings.Fields(out)
+	if len(fields) < 2 {
+		return goPackage{}, fmt.Errorf("unexpected output of 'go list %s': %s", main, out)
+	}
+
+	pkg := goPackage{name: fields[0], importPath: fields[1]}
+	if len(fields) > 2 {
+		pkg.module = fields[2]
+	}
+	return pkg, nil
+}
+
+// coverPackages returns the sorted import paths of the packages matching the comma separated '-coverpkg' patterns
+func coverPackages(ctx context.Context, coverPkg string, platform *ggcrv1.Platform) ([]string, error) {
+	args := append([]string{"list", "-f", "{{.ImportPath}}"}, strings.Split(coverPkg, ",")...)
+	out, err := goTool(ctx, buildEnv(platform), args...)
+	if err != nil {
+		return nil, err
+	}
+
+	pkgs := strings.Fields(out)
+	sort.Strings(pkgs)
+	return pkgs, nil
+}
+
+// buildEnv returns the environment variables to build a static binary for the platform
+func buildEnv(platform *ggcrv1.Platform) []string {
+	env := []string{"CGO_ENABLED=0", "GOOS=" + platform.OS, "GOARCH=" + platform.Architecture}
+	if platform.Architecture == "arm" && platform.Variant != "" {
+		env = append(env, "GOARM="+strings.TrimPrefix(platform.Variant, "v"))
+	}
+	return env
+}
+
+func buildBinary(ctx context.Context, opts BuildOptions, platform *ggcrv1.Platform, binPath string) error {
+	env := buildEnv(platform)
+
+	s := newSpinner(ctx)
+	s.Suffix = " Building Binary"
+	s.Start()
+
+	start := time.Now()
+	_, err := goTool(ctx, env, "build", "-cover", "-coverpkg="+opts.CoverPkg, "-o", binPath, opts.Main)
+	s.Stop()
+	if err != nil {
+		return err
+	}
+
+	elapsed := time.Since(start).Round(time.Second)
+	report(ctx, Event{Resource: fmt.Sprintf("Binary '%s'", filepath.Base(binPath)), Action: "build", Duration: elapsed},
+		"✅ Binary built with '-cover -coverpkg=%s' for %s [%v]", opts.CoverPkg, platform, elapsed)
+	return nil
+}
+
+// baseImage returns the base image for the platform, from its registry
+func baseImage(ctx context.Context, base string, platform *ggcrv1.Platform) (ggcrv1.Image, error) {
+	if base == BaseScratch {
+		return empty.Image, nil
+	}
+
+	ref, err := name.ParseReference(base)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base image '%s': %w", base, err)
+	}
+
+	img, err := remote.Image(ref,
+		remote.WithContext(ctx),
+		remote.WithAuthFromKeychain(authn.DefaultKeychain),
+		remote.WithPlatform(*platform),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error pulling base image '%s': %w", base, err)
+	}
+	return img, nil
+}
+
+// layerBinary adds the binary in a new layer of the base image, as its entrypoint
+func layerBinary(base ggcrv1.Image, binPath string, platform *ggcrv1.Platform, labels map[string]string) (ggcrv1.Image, error) {
+	data, err := binaryLayerTar(binPath)
+	if err != nil {
+		return nil, err
+	}
+
+	layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	img, err := mutate.AppendLayers(base, layer)
+	if err != nil {
+		return nil, err
+	}
+
+	configFile, err := img.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	configFile = configFile.DeepCopy()
+
+	configFile.OS = platform.OS
+	configFile.Architecture = platform.Architecture
+	configFile.Variant = platform.Variant
+	configFile.Created = ggcrv1.Time{Time: time.Now()}
+	configFile.Config.Entrypoint = []string{"/" + path.Join(binDir, filepath.Base(binPath))}
+	configFile.Config.Cmd = nil
+	if configFile.Config.Labels == nil {
+		configFile.Config.Labels = map[string]string{}
+	}
+	for k, v := range labels {
+		configFile.Config.Labels[k] = v
+	}
+
+	return mutate.ConfigFile(img, configFile)
+}
+
+// binaryLayerTar returns the tar of the layer with the binary, and its parent directories
+func binaryLayerTar(binPath string) ([]byte, error) {
+	bin, err := os.ReadFile(binPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+
+	dir := ""
+	for _, d := range strings.Split(binDir, "/") {
+		dir = path.Join(dir, d)
+		err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: dir + "/", Mode: 0o755})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     path.Join(binDir, filepath.Base(binPath)),
+		Mode:     0o755,
+		Size:     int64(len(bin)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	_, err = tw.Write(bin)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tw.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeOCITarball writes the image in an OCI image layout, archived in a tar file
+func writeOCITarball(dst string, ref name.Reference, img ggcrv1.Image) error {
+	layoutDir, err := os.MkdirTemp("", "gocoverkube-oci-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(layoutDir)
+
+	p, err := layout.Write(layoutDir, empty.Index)
+	if err != nil {
+		return err
+	}
+	err = p.AppendImage(img, layout.WithAnnotations(map[string]string{
+		"org.opencontainers.image.ref.name": ref.String(),
+	}))
+	if err != nil {
+		return err
+	}
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	tw := tar.NewWriter(out)
+	err = filepath.WalkDir(layoutDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || p == layoutDir {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(layoutDir, p)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+		if d.IsDir() {
+			header.Name += "/"
+		}
+
+		err = tw.WriteHeader(header)
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	err = tw.Close()
+	if err != nil {
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,294 @@
+package cmd
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	ggcrv1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+)
+
+// writeBinary writes a fake binary in a temporary directory
+func writeBinary(t *testing.T, content string) string {
+	t.Helper()
+
+	binPath := filepath.Join(t.TempDir(), "app")
+	if err := os.WriteFile(binPath, []byte(content), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return binPath
+}
+
+func TestBuildEnv(t *testing.T) {
+	tests := []struct {
+		name     string
+		platform *ggcrv1.Platform
+		want     []string
+	}{
+		{
+			name:     "amd64",
+			platform: &ggcrv1.Platform{OS: "linux", Architecture: "amd64"},
+			want:     []string{"CGO_ENABLED=0", "GOOS=linux", "GOARCH=amd64"},
+		},
+		{
+			name:     "arm with variant",
+			platform: &ggcrv1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"},
+			want:     []string{"CGO_ENABLED=0", "GOOS=linux", "GOARCH=arm", "GOARM=7"},
+		},
+		{
+			name:     "arm without variant",
+			platform: &ggcrv1.Platform{OS: "linux", Architecture: "arm"},
+			want:     []string{"CGO_ENABLED=0", "GOOS=linux", "GOARCH=arm"},
+		},
+		{
+			name:     "arm64 variant is not GOARM",
+			platform: &ggcrv1.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"},
+			want:     []string{"CGO_ENABLED=0", "GOOS=linux", "GOARCH=arm64"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := buildEnv(tt.platform)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBinaryLayerTar(t *testing.T) {
+	binPath := writeBinary(t, "binary")
+
+	data, err := binaryLayerTar(binPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	type entry struct {
+		typeflag byte
+		mode     int64
+		content  string
+	}
+	got := map[string]entry{}
+	names := []string{}
+	tr := tar.NewReader(bytes.NewReader(data))
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("invalid tar: %v", err)
+		}
+		content, _ := io.ReadAll(tr)
+		got[header.Name] = entry{typeflag: header.Typeflag, mode: header.Mode, content: string(content)}
+		names = append(names, header.Name)
+	}
+
+	// the parent directories come before the binary
+	wantNames := []string{"usr/", "usr/local/", "usr/local/bin/", "usr/local/bin/app"}
+	if !reflect.DeepEqual(names, wantNames) {
+		t.Errorf("got entries %v, want %v", names, wantNames)
+	}
+
+	want := map[string]entry{
+		"usr/":              {typeflag: tar.TypeDir, mode: 0o755},
+		"usr/local/":        {typeflag: tar.TypeDir, mode: 0o755},
+		"usr/local/bin/":    {typeflag: tar.TypeDir, mode: 0o755},
+		"usr/local/bin/app": {typeflag: tar.TypeReg, mode: 0o755, content: "binary"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestBinaryLayerTarMissingBinary(t *testing.T) {
+	_, err := binaryLayerTar(filepath.Join(t.TempDir(), "missing"))
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected a not exist error, got %v", err)
+	}
+}
+
+func TestLayerBinary(t *testing.T) {
+	binPath := writeBinary(t, "binary")
+
+	base, err := mutate.Config(empty.Image, ggcrv1.Config{
+		Env:    []string{"PATH=/bin"},
+		Cmd:    []string{"sh"},
+		Labels: map[string]string{"base": "label", ImageLabelMain: "base"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		base       ggcrv1.Image
+		platform   *ggcrv1.Platform
+		labels     map[string]string
+		wantLabels map[string]string
+		wantEnv    []string
+	}{
+		{
+			name:       "scratch",
+			base:       empty.Image,
+			platform:   &ggcrv1.Platform{OS: "linux", Architecture: "amd64"},
+			labels:     map[string]string{ImageLabelMain: "./cmd/app"},
+			wantLabels: map[string]string{ImageLabelMain: "./cmd/app"},
+		},
+		{
+			name:     "labels merged into the base config",
+			base:     base,
+			platform: &ggcrv1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"},
+			labels:   map[string]string{ImageLabelMain: "./cmd/app", ImageLabelCoverPkg: "./..."},
+			wantLabels: map[string]string{
+				"base":             "label",
+				ImageLabelMain:     "./cmd/app",
+				ImageLabelCoverPkg: "./...",
+			},
+			wantEnv: []string{"PATH=/bin"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img, err := layerBinary(tt.base, binPath, tt.platform, tt.labels)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			configFile, err := img.ConfigFile()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := configFile.Platform(); !reflect.DeepEqual(got, tt.platform) {
+				t.Errorf("got platform %v, want %v", got, tt.platform)
+			}
+			if want := []string{"/usr/local/bin/app"}; !reflect.DeepEqual(configFile.Config.Entrypoint, want) {
+				t.Errorf("got entrypoint %v, want %v", configFile.Config.Entrypoint, want)
+			}
+			// the command of the base would be the arguments of the binary
+			if configFile.Config.Cmd != nil {
+				t.Errorf("got cmd %v, want none", configFile.Config.Cmd)
+			}
+			if !reflect.DeepEqual(configFile.Config.Labels, tt.wantLabels) {
+				t.Errorf("got labels %v, want %v", configFile.Config.Labels, tt.wantLabels)
+			}
+			if !reflect.DeepEqual(configFile.Config.Env, tt.wantEnv) {
+				t.Errorf("got env %v, want %v", configFile.Config.Env, tt.wantEnv)
+			}
+
+			layers, err := img.Layers()
+			if err != nil {
+				t.Fatal(err)
+			}
+			baseLayers, _ := tt.base.Layers()
+			if len(layers) != len(baseLayers)+1 {
+				t.Errorf("got %d layers, want %d", len(layers), len(baseLayers)+1)
+			}
+		})
+	}
+
+	// the base image is not changed
+	baseConfig, _ := base.ConfigFile()
+	if want := map[string]string{"base": "label", ImageLabelMain: "base"}; !reflect.DeepEqual(baseConfig.Config.Labels, want) {
+		t.Errorf("base labels changed to %v", baseConfig.Config.Labels)
+	}
+}
+
+func TestWriteOCITarball(t *testing.T) {
+	img, err := layerBinary(empty.Image, writeBinary(t, "binary"), &ggcrv1.Platform{OS: "linux", Architecture: "amd64"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := name.ParseReference("example.com/app:cover")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst := filepath.Join(t.TempDir(), "app.oci.tar")
+	err = writeOCITarball(dst, ref, img)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the archive is extracted to be read as a layout
+	layoutDir := t.TempDir()
+	f, err := os.Open(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tr := tar.NewReader(f)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("invalid tar: %v", err)
+		}
+		target := filepath.Join(layoutDir, filepath.FromSlash(header.Name))
+		if header.Typeflag == tar.TypeDir {
+			if err := os.MkdirAll(target, os.ModePerm); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		content, _ := io.ReadAll(tr)
+		if err := os.WriteFile(target, content, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	p, err := layout.FromPath(layoutDir)
+	if err != nil {
+		t.Fatalf("invalid layout: %v", err)
+	}
+	index, err := p.ImageIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Manifests) != 1 {
+		t.Fatalf("got %d manifests, want 1", len(manifest.Manifests))
+	}
+
+	desc := manifest.Manifests[0]
+	if got := desc.Annotations["org.opencontainers.image.ref.name"]; got != ref.String() {
+		t.Errorf("got ref name %q, want %q", got, ref.String())
+	}
+	wantDigest, _ := img.Digest()
+	if desc.Digest != wantDigest {
+		t.Errorf("got digest %s, want %s", desc.Digest, wantDigest)
+	}
+
+	// the blobs of the image are in the layout
+	got, err := p.Image(desc.Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers, err := got.Layers()
+	if err != nil || len(layers) != 1 {
+		t.Fatalf("got %d layers, want 1: %v", len(layers), err)
+	}
+	if _, err := layers[0].Compressed(); err != nil {
+		t.Errorf("layer not readable: %v", err)
+	}
+}
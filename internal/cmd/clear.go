@@ -2,12 +2,15 @@ package cmd
 
 import (
 	"context"
-	"fmt"
+	"strings"
 
+	appsv1 "k8s.io/api/apps/v1"
 	v1 "k8s.io/api/core/v1"
 	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	appsv1ac "k8s.io/client-go/applyconfigurations/apps/v1"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
 )
 
 // gocoverkube clear
@@ -18,67 +21,151 @@ func ClearPod(ctx context.Context, clientset kubernetes.Interface, namespace, po
 		return err
 	}
 
+	if container, found := instrumentedContainer(pod.Spec); found {
+		i, _ := containerIndex(pod.Spec, container)
+		restoreImage(ctx, pod.Annotations, &pod.Spec.Containers[i])
+	}
 	pod.Spec = clearPodSpec(ctx, pod.Spec)
 	err = deleteAndCreatePod(ctx, clientset, namespace, pod)
 	if err != nil {
 		return err
 	}
 
-	err = deleteCollectorPod(ctx, clientset, namespace)
+	return clearCollector(ctx, clientset, namespace, "pod/"+podName)
+}
+
+// gocoverkube clear
+func ClearDeployment(ctx context.Context, clientset kubernetes.Interface, namespace, deploymentName string) error {
+	err := clearDeploymentSpec(ctx, clientset, namespace, deploymentName)
 	if err != nil {
 		return err
 	}
 
-	pvcClient := clientset.CoreV1().PersistentVolumeClaims(namespace)
-	err = pvcClient.Delete(ctx, pvcName, metav1.DeleteOptions{})
+	return clearCollector(ctx, clientset, namespace, "deployment/"+deploymentName)
+}
+
+// clearCollector removes the target from the session, deleting the collector pod, the Secret, the PVC and the session
+// if no other target in the namespace is still using them
+func clearCollector(ctx context.Context, clientset kubernetes.Interface, namespace, target string) error {
+	remaining, err := removeSessionTarget(ctx, clientset, namespace, target)
 	if err != nil {
-		if !k8serrors.IsNotFound(err) {
-			return err
-		}
+		return err
+	}
+	if len(remaining) > 0 {
+		report(ctx, Event{Resource: sessionResource, Action: "delete", Result: "skipped"},
+			"ℹ️  Keeping the collector and the PVC, still used by '%s'", strings.Join(remaining, "', '"))
+		return nil
 	}
-	fmt.Println("✅ PVC deleted")
 
-	return nil
-}
+	err = deleteCollectorPod(ctx, clientset, namespace)
+	if err != nil {
+		return err
+	}
 
-// gocoverkube clear
-func ClearDeployment(ctx context.Context, clientset kubernetes.Interface, namespace, deploymentName string) error {
-	deploymentClient := clientset.AppsV1().Deployments(namespace)
-	deployment, err := deploymentClient.Get(ctx, deploymentName, metav1.GetOptions{})
+	err = deleteCollectorSecret(ctx, clientset, namespace)
 	if err != nil {
 		return err
 	}
 
-	deployment.Spec.Template.Spec = clearPodSpec(ctx, deployment.Spec.Template.Spec)
-	err = updateAndRestartDeployment(ctx, clientset, namespace, deployment)
+	err = deletePVC(ctx, clientset, namespace)
 	if err != nil {
 		return err
 	}
 
-	err = deleteCollectorPod(ctx, clientset, namespace)
+	return deleteSession(ctx, clientset, namespace)
+}
+
+// clearDeploymentSpec removes the coverage volume and env var from the deployment, restarting it.
+// It applies an empty configuration, releasing the fields owned by gocoverkube. A swapped image is restored before,
+// with an update that takes it away from gocoverkube: applying without it would remove the image.
+func clearDeploymentSpec(ctx context.Context, clientset kubernetes.Interface, namespace, deploymentName string) error {
+	deploymentClient := clientset.AppsV1().Deployments(namespace)
+	deployment, err := deploymentClient.Get(ctx, deploymentName, metav1.GetOptions{})
 	if err != nil {
 		return err
 	}
 
+	return rolloutDeployment(ctx, clientset, namespace, deployment, func(ctx context.Context) (*appsv1.Deployment, error) {
+		if _, swapped := deployment.Spec.Template.Annotations[originalImageAnnotation]; swapped {
+			_, err := updateDeployment(ctx, clientset, namespace, deploymentName, func(d *appsv1.Deployment) {
+				restoreTemplateImage(ctx, &d.Spec.Template)
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		updated, err := applyDeployment(ctx, clientset, namespace, appsv1ac.Deployment(deploymentName, namespace), false)
+		if err != nil || !isInstrumented(updated.Spec.Template.Spec) {
+			return updated, err
+		}
+
+		// the fields are owned also by other managers, i.e. instrumented with an update by an older version
+		return updateDeployment(ctx, clientset, namespace, deploymentName, func(d *appsv1.Deployment) {
+			restoreTemplateImage(ctx, &d.Spec.Template)
+			d.Spec.Template.Spec = clearPodSpec(ctx, d.Spec.Template.Spec)
+		})
+	})
+}
+
+// updateDeployment changes the deployment with an update, retrying on conflicts
+func updateDeployment(ctx context.Context, clientset kubernetes.Interface, namespace, deploymentName string, change func(*appsv1.Deployment)) (*appsv1.Deployment, error) {
+	deploymentClient := clientset.AppsV1().Deployments(namespace)
+
+	var updated *appsv1.Deployment
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		current, err := deploymentClient.Get(ctx, deploymentName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		change(current)
+		updated, err = deploymentClient.Update(ctx, current, metav1.UpdateOptions{FieldManager: fieldManager})
+		return err
+	})
+
+	return updated, err
+}
+
+// restoreTemplateImage restores the original image of the instrumented container of the pod template, if it was swapped
+func restoreTemplateImage(ctx context.Context, template *v1.PodTemplateSpec) {
+	container, found := instrumentedContainer(template.Spec)
+	if !found {
+		return
+	}
+	i, _ := containerIndex(template.Spec, container)
+	restoreImage(ctx, template.Annotations, &template.Spec.Containers[i])
+}
+
+func deletePVC(ctx context.Context, clientset kubernetes.Interface, namespace string) error {
 	pvcClient := clientset.CoreV1().PersistentVolumeClaims(namespace)
-	err = pvcClient.Delete(ctx, pvcName, metav1.DeleteOptions{})
+	err := pvcClient.Delete(ctx, pvcName, metav1.DeleteOptions{})
 	if err != nil {
 		if !k8serrors.IsNotFound(err) {
 			return err
 		}
 	}
-	fmt.Println("✅ PVC deleted")
+	trackResource(ctx, pvcResource, "deleted")
+	report(ctx, Event{Resource: pvcResource, Action: "delete"}, "✅ PVC deleted")
 
 	return nil
 }
 
+// clearPodSpec removes the coverage volume from the pod spec, and its mount and env var from the instrumented container
 func clearPodSpec(ctx context.Context, podSpec v1.PodSpec) v1.PodSpec {
-	container := podSpec.Containers[0]
+	name, found := instrumentedContainer(podSpec)
+	if !found {
+		podSpec.Volumes = unsetVolume(podSpec.Volumes)
+		return podSpec
+	}
+	i, _ := containerIndex(podSpec, name)
+
+	container := podSpec.Containers[i]
 	// unset GOCOVERDIR env var
 	container.Env = unsetEnvVar(container.Env)
 	// unmount /tmp/coverage volume
 	container.VolumeMounts = unsetVolumeMount(container.VolumeMounts)
-	podSpec.Containers[0] = container
+	podSpec.Containers[i] = container
 
 	// unbind /tmp/coverage volume to PVC
 	podSpec.Volumes = unsetVolume(podSpec.Volumes)
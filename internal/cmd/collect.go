@@ -7,116 +7,100 @@ import (
 
 	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/runtime/schema"
-	"k8s.io/apimachinery/pkg/runtime/serializer"
-	"k8s.io/cli-runtime/pkg/genericclioptions"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
-	"k8s.io/kubectl/pkg/cmd/cp"
-	"k8s.io/kubectl/pkg/scheme"
 )
 
 const (
 	collectorName = "gocoverkube-collector"
 )
 
-// gocoverkube collect
-func Collect(ctx context.Context, clientset kubernetes.Interface, config *rest.Config, namespace, deploymentName, outDst string) error {
-	// TODO add timeout flag
-
+// RestartDeployment restarts the instrumented deployment, flushing the coverage counters to the volume
+func RestartDeployment(ctx context.Context, clientset kubernetes.Interface, namespace, deploymentName string) error {
 	deploymentClient := clientset.AppsV1().Deployments(namespace)
 	deployment, err := deploymentClient.Get(ctx, deploymentName, metav1.GetOptions{})
 	if err != nil {
 		return err
 	}
 
-	pvcClient := clientset.CoreV1().PersistentVolumeClaims(namespace)
-	_, err = pvcClient.Get(ctx, pvcName, metav1.GetOptions{})
-	if err != nil {
-		if k8serrors.IsNotFound(err) {
-			return errors.New("PVC not found. Did you run 'init'?")
-		}
-		return err
+	// the restart re-applies all the fields owned by gocoverkube, it can't be done on a deployment not instrumented
+	container, found := instrumentedContainer(deployment.Spec.Template.Spec)
+	if !found {
+		return fmt.Errorf("deployment '%s' is not instrumented, run 'gocoverkube init' first", deploymentName)
 	}
 
-	err = updateAndRestartDeployment(ctx, clientset, namespace, deployment)
+	err = checkPVC(ctx, clientset, namespace)
 	if err != nil {
 		return err
 	}
 
-	podExec := NewPodExec(config, clientset)
-	err = podExec.PodCopyFile(collectorName+":/tmp/coverage", outDst, namespace)
+	// the image swapped by init is applied again
+	i, _ := containerIndex(deployment.Spec.Template.Spec, container)
+	swap, err := newImageSwap(deployment.Spec.Template.Annotations, deployment.Spec.Template.Spec.Containers[i], ImageOptions{})
 	if err != nil {
 		return err
 	}
 
-	fmt.Printf("ℹ️  Coverage collected at '%s'\n", outDst)
-
-	return nil
+	// the fields were owned by gocoverkube, they are not taken over if changed by someone else in the meantime
+	return instrumentDeployment(ctx, clientset, namespace, deployment, container, swap, false)
 }
 
-func CollectPod(ctx context.Context, clientset kubernetes.Interface, config *rest.Config, namespace, podName, outDst string) error {
-	// TODO add timeout flag
-
+// RestartPod re-creates the instrumented pod, flushing the coverage counters to the volume
+func RestartPod(ctx context.Context, clientset kubernetes.Interface, namespace, podName string) error {
 	podClient := clientset.CoreV1().Pods(namespace)
 	pod, err := podClient.Get(ctx, podName, metav1.GetOptions{})
 	if err != nil {
 		return err
 	}
 
-	pvcClient := clientset.CoreV1().PersistentVolumeClaims(namespace)
-	_, err = pvcClient.Get(ctx, pvcName, metav1.GetOptions{})
+	err = checkPVC(ctx, clientset, namespace)
 	if err != nil {
-		if k8serrors.IsNotFound(err) {
-			return errors.New("PVC not found. Did you run 'init'?")
-		}
 		return err
 	}
 
-	err = deleteAndCreatePod(ctx, clientset, namespace, pod)
+	return deleteAndCreatePod(ctx, clientset, namespace, pod)
+}
+
+// CollectFiles copies the coverage files already on the volume, without restarting the workload
+func CollectFiles(ctx context.Context, clientset kubernetes.Interface, config *rest.Config, namespace, outDst string, copyOpts CopyOptions) error {
+	err := checkPVC(ctx, clientset, namespace)
 	if err != nil {
 		return err
 	}
 
-	podExec := NewPodExec(config, clientset)
-	err = podExec.PodCopyFile(collectorName+":/tmp/coverage", outDst, namespace)
+	err = copyCoverage(ctx, clientset, config, namespace, outDst, copyOpts)
 	if err != nil {
 		return err
 	}
 
-	fmt.Printf("ℹ️  Coverage collected at '%s'\n", outDst)
+	reportCollected(ctx, outDst)
 
 	return nil
 }
 
-type PodExec struct {
-	RestConfig *rest.Config
-	Clientset  kubernetes.Interface
-}
-
-func NewPodExec(config *rest.Config, clientset kubernetes.Interface) *PodExec {
-	config.APIPath = "/api"                                   // Make sure we target /api and not just /
-	config.GroupVersion = &schema.GroupVersion{Version: "v1"} // this targets the core api groups so the url path will be /api/v1
-	config.NegotiatedSerializer = serializer.WithoutConversionCodecFactory{CodecFactory: scheme.Codecs}
-
-	return &PodExec{
-		RestConfig: config,
-		Clientset:  clientset,
+func checkPVC(ctx context.Context, clientset kubernetes.Interface, namespace string) error {
+	pvcClient := clientset.CoreV1().PersistentVolumeClaims(namespace)
+	_, err := pvcClient.Get(ctx, pvcName, metav1.GetOptions{})
+	if err != nil {
+		if k8serrors.IsNotFound(err) {
+			return errors.New("PVC not found. Did you run 'init'?")
+		}
+		return err
 	}
+	return nil
 }
 
-func (p *PodExec) PodCopyFile(src string, dst string, namespace string) error {
-	ioStreams, _, _, _ := genericclioptions.NewTestIOStreams()
-	copyOptions := cp.NewCopyOptions(ioStreams)
-
-	copyOptions.Clientset = p.Clientset
-	copyOptions.ClientConfig = p.RestConfig
-	copyOptions.Container = collectorName
-	copyOptions.Namespace = namespace
-
-	err := copyOptions.Run([]string{src, dst})
+func copyCoverage(ctx context.Context, clientset kubernetes.Interface, config *rest.Config, namespace, outDst string, copyOpts CopyOptions) error {
+	source, err := newCollectorSource(ctx, config, clientset, namespace)
 	if err != nil {
-		return fmt.Errorf("Could not run copy operation: %v", err)
+		return err
 	}
-	return nil
+	defer source.Close()
+
+	return NewCopier(source, copyOpts).Copy(ctx, outDst)
+}
+
+func reportCollected(ctx context.Context, outDst string) {
+	report(ctx, Event{Action: "collect"}, "ℹ️  Coverage collected at '%s'", outDst)
+	setResult(ctx, "outputDir", outDst)
 }
@@ -0,0 +1,223 @@
+package cmd
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/enrichman/gocoverkube/internal/collector"
+)
+
+const (
+	collectorImageRepository = "ghcr.io/enrichman/gocoverkube-collector"
+	defaultCollectorUser     = int64(65532)
+
+	collectorSecretName = "gocoverkube-collector"
+	collectorTokenKey   = "token"
+	collectorPortName   = "collector-api"
+
+	collectorResource       = "Collector Pod '" + collectorName + "'"
+	collectorSecretResource = "Collector Secret '" + collectorSecretName + "'"
+)
+
+// CollectorOptions configures the collector pod that mounts the coverage volume.
+type CollectorOptions struct {
+	Image string
+	// Command overrides the entrypoint of the image, to use an image without the collector API.
+	// The files are then copied with the shell utilities of the image.
+	Command          []string
+	ImagePullSecrets []string
+	Resources        v1.ResourceRequirements
+	Tolerations      []v1.Toleration
+	NodeSelector     map[string]string
+
+	RunAsUser              int64
+	RunAsGroup             int64
+	FSGroup                int64
+	ReadOnlyRootFilesystem bool
+}
+
+// defaultCollectorImage returns the collector image released with this version, 'latest' for the dev builds
+func defaultCollectorImage() string {
+	if Version == devVersion {
+		return collectorImageRepository + ":latest"
+	}
+	return collectorImageRepository + ":" + Version
+}
+
+// DefaultCollectorOptions returns a spec that passes the 'restricted' Pod Security Standard.
+func DefaultCollectorOptions() CollectorOptions {
+	return CollectorOptions{
+		Image: defaultCollectorImage(),
+		Resources: v1.ResourceRequirements{
+			Requests: v1.ResourceList{
+				v1.ResourceCPU:    resource.MustParse("10m"),
+				v1.ResourceMemory: resource.MustParse("16Mi"),
+			},
+			Limits: v1.ResourceList{
+				v1.ResourceCPU:    resource.MustParse("100m"),
+				v1.ResourceMemory: resource.MustParse("64Mi"),
+			},
+		},
+		RunAsUser:              defaultCollectorUser,
+		RunAsGroup:             defaultCollectorUser,
+		FSGroup:                defaultCollectorUser,
+		ReadOnlyRootFilesystem: true,
+	}
+}
+
+func newCollectorPod(opts CollectorOptions, owners []metav1.OwnerReference) *v1.Pod {
+	runAsNonRoot := true
+	allowPrivilegeEscalation := false
+
+	pullSecrets := []v1.LocalObjectReference{}
+	for _, name := range opts.ImagePullSecrets {
+		pullSecrets = append(pullSecrets, v1.LocalObjectReference{Name: name})
+	}
+
+	container := v1.Container{
+		Name:      collectorName,
+		Image:     opts.Image,
+		Resources: opts.Resources,
+		SecurityContext: &v1.SecurityContext{
+			RunAsNonRoot:             &runAsNonRoot,
+			AllowPrivilegeEscalation: &allowPrivilegeEscalation,
+			ReadOnlyRootFilesystem:   &opts.ReadOnlyRootFilesystem,
+			Capabilities: &v1.Capabilities{
+				Drop: []v1.Capability{"ALL"},
+			},
+		},
+		VolumeMounts: []v1.VolumeMount{{
+			Name:      volumeName,
+			MountPath: mountPath,
+		}},
+	}
+
+	if len(opts.Command) > 0 {
+		container.Command = opts.Command
+	} else {
+		container.Args = []string{"--dir", mountPath}
+		container.Ports = []v1.ContainerPort{{
+			Name:          collectorPortName,
+			ContainerPort: collector.Port,
+		}}
+		container.Env = []v1.EnvVar{{
+			Name: collector.TokenEnvVar,
+			ValueFrom: &v1.EnvVarSource{
+				SecretKeyRef: &v1.SecretKeySelector{
+					LocalObjectReference: v1.LocalObjectReference{Name: collectorSecretName},
+					Key:                  collectorTokenKey,
+				},
+			},
+		}}
+		container.ReadinessProbe = &v1.Probe{
+			ProbeHandler: v1.ProbeHandler{
+				HTTPGet: &v1.HTTPGetAction{
+					Path: "/healthz",
+					Port: intstr.FromString(collectorPortName),
+				},
+			},
+		}
+	}
+
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            collectorName,
+			Labels:          managedLabels("collector"),
+			OwnerReferences: owners,
+		},
+		Spec: v1.PodSpec{
+			ImagePullSecrets: pullSecrets,
+			Tolerations:      opts.Tolerations,
+			NodeSelector:     opts.NodeSelector,
+			SecurityContext: &v1.PodSecurityContext{
+				RunAsNonRoot: &runAsNonRoot,
+				RunAsUser:    &opts.RunAsUser,
+				RunAsGroup:   &opts.RunAsGroup,
+				FSGroup:      &opts.FSGroup,
+				SeccompProfile: &v1.SeccompProfile{
+					Type: v1.SeccompProfileTypeRuntimeDefault,
+				},
+			},
+			Containers: []v1.Container{container},
+			Volumes: []v1.Volume{{
+				Name: volumeName,
+				VolumeSource: v1.VolumeSource{
+					PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{
+						ClaimName: pvcName,
+					},
+				},
+			}},
+		},
+	}
+}
+
+// createCollectorSecret creates the Secret with the token used to authenticate to the collector API.
+// It returns true if the Secret was created.
+func createCollectorSecret(ctx context.Context, clientset kubernetes.Interface, namespace string, owners []metav1.OwnerReference) (bool, error) {
+	token := make([]byte, 32)
+	_, err := rand.Read(token)
+	if err != nil {
+		return false, err
+	}
+
+	secretClient := clientset.CoreV1().Secrets(namespace)
+	_, err = secretClient.Create(ctx, &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            collectorSecretName,
+			Labels:          managedLabels("collector"),
+			OwnerReferences: owners,
+		},
+		StringData: map[string]string{
+			collectorTokenKey: hex.EncodeToString(token),
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		if !k8serrors.IsAlreadyExists(err) {
+			return false, err
+		}
+		return false, nil
+	}
+	trackResource(ctx, collectorSecretResource, "created")
+
+	return true, nil
+}
+
+func deleteCollectorSecret(ctx context.Context, clientset kubernetes.Interface, namespace string) error {
+	err := clientset.CoreV1().Secrets(namespace).Delete(ctx, collectorSecretName, metav1.DeleteOptions{})
+	if err != nil {
+		if !k8serrors.IsNotFound(err) {
+			return err
+		}
+	}
+	trackResource(ctx, collectorSecretResource, "deleted")
+	return nil
+}
+
+func collectorToken(ctx context.Context, clientset kubernetes.Interface, namespace string) (string, error) {
+	secret, err := clientset.CoreV1().Secrets(namespace).Get(ctx, collectorSecretName, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("error getting collector token: %w", err)
+	}
+	return string(secret.Data[collectorTokenKey]), nil
+}
+
+// hasCollectorAPI returns true if the collector pod is serving the collector API
+func hasCollectorAPI(pod *v1.Pod) bool {
+	for _, c := range pod.Spec.Containers {
+		for _, p := range c.Ports {
+			if p.Name == collectorPortName {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,411 @@
+package cmd
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/briandowns/spinner"
+)
+
+const (
+	archiveName = "coverage.tar.gz"
+	// copyRetryDelay is the delay before the first retry of a copy, doubled at every next one
+	copyRetryDelay = time.Second
+)
+
+// CopyOptions configures how the files are copied from the collector pod.
+type CopyOptions struct {
+	Compress bool
+	Retries  int
+	// Archive downloads a single tar.gz archive instead of the files
+	Archive bool
+	// Prune deletes the files from the volume once they are copied and verified
+	Prune bool
+	// Incremental copies only the coverage files not already in the manifest of the output directory
+	Incremental bool
+}
+
+func DefaultCopyOptions() CopyOptions {
+	return CopyOptions{
+		Compress: true,
+		Retries:  3,
+	}
+}
+
+// Copier copies the coverage files from a fileSource, verifying their checksums
+// and resuming the interrupted transfers.
+type Copier struct {
+	source fileSource
+	opts   CopyOptions
+}
+
+func NewCopier(source fileSource, opts CopyOptions) *Copier {
+	return &Copier{
+		source: source,
+		opts:   opts,
+	}
+}
+
+// Copy copies all the files of the source into the local directory dst
+func (c *Copier) Copy(ctx context.Context, dst string) error {
+	if c.opts.Archive {
+		return c.copyArchive(ctx, dst)
+	}
+
+	files, err := c.source.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	var m *manifest
+	if c.opts.Incremental {
+		m, err = loadManifest(dst)
+		if err != nil {
+			return fmt.Errorf("error loading manifest: %w", err)
+		}
+	}
+
+	err = checkCoverageFiles(files, m)
+	// the incremental collections copy what is there, the counters can be written later
+	if errors.Is(err, errNoCoverageCounters) && m != nil {
+		warn(ctx, "⚠️  %s, nothing new to merge yet", err)
+	} else if err != nil {
+		return err
+	}
+
+	newFiles := []remoteFile{}
+	for _, f := range files {
+		if m != nil && (!isCoverageFile(f.path) || m.Contains(f)) {
+			continue
+		}
+		newFiles = append(newFiles, f)
+	}
+
+	progress := newCopyProgress(ctx, newFiles)
+	progress.Start()
+	defer progress.Stop()
+
+	resource := fmt.Sprintf("Output directory '%s'", dst)
+	for i, f := range newFiles {
+		trackResource(ctx, resource, fmt.Sprintf("%d of %d files copied", i, len(newFiles)))
+
+		err := c.copyFile(ctx, dst, f, progress)
+		if err != nil {
+			return err
+		}
+
+		// save the manifest after every file, so an interrupted collection does not copy them again
+		if m != nil {
+			m.Add(f)
+			if err := m.Save(); err != nil {
+				return fmt.Errorf("error saving manifest: %w", err)
+			}
+		}
+	}
+
+	progress.Stop()
+	trackResource(ctx, resource, fmt.Sprintf("%d files copied", len(newFiles)))
+	if m != nil {
+		report(ctx, Event{Resource: resource, Action: "copy", Duration: progress.Elapsed()},
+			"✅ Copied %d new files, %s, %d already collected [%v]", len(newFiles), formatBytes(progress.total), len(files)-len(newFiles), progress.Elapsed())
+	} else {
+		report(ctx, Event{Resource: resource, Action: "copy", Duration: progress.Elapsed()},
+			"✅ Copied %d files, %s [%v]", len(files), formatBytes(progress.total), progress.Elapsed())
+	}
+	setResult(ctx, "filesCopied", len(newFiles))
+	setResult(ctx, "bytesCopied", progress.total)
+
+	if c.opts.Prune {
+		return c.prune(ctx, files, m)
+	}
+
+	return nil
+}
+
+// prune deletes the copied files from the volume. In incremental mode the files
+// collected by the previous runs are deleted as well.
+func (c *Copier) prune(ctx context.Context, files []remoteFile, m *manifest) error {
+	deleted := 0
+	for _, f := range files {
+		if m != nil && !m.Contains(f) {
+			continue
+		}
+
+		err := c.source.Delete(ctx, f.path)
+		if err != nil {
+			return fmt.Errorf("error deleting '%s': %w", f.path, err)
+		}
+		deleted++
+	}
+
+	report(ctx, Event{Resource: pvcResource, Action: "prune"}, "✅ Deleted %d files from the volume", deleted)
+	setResult(ctx, "filesPruned", deleted)
+	return nil
+}
+
+func (c *Copier) copyArchive(ctx context.Context, dst string) error {
+	files, err := c.source.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = checkCoverageFiles(files, nil)
+	if err != nil {
+		return err
+	}
+
+	archive, err := c.source.Archive(ctx)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	out, err := os.Create(filepath.Join(dst, archiveName))
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	progress := newCopyProgress(ctx, nil)
+	progress.archive = true
+	progress.Start()
+	defer progress.Stop()
+
+	_, err = io.Copy(&progressWriter{w: out, name: archiveName, progress: progress}, archive)
+	if err != nil {
+		return fmt.Errorf("error downloading archive: %w", err)
+	}
+
+	progress.Stop()
+	report(ctx, Event{Resource: fmt.Sprintf("Archive '%s'", archiveName), Action: "download", Duration: progress.Elapsed()},
+		"✅ Archive downloaded, %s [%v]", formatBytes(progress.done), progress.Elapsed())
+	setResult(ctx, "bytesCopied", progress.done)
+
+	return nil
+}
+
+func (c *Copier) copyFile(ctx context.Context, dst string, f remoteFile, progress *copyProgress) error {
+	// the names come from the collector, they must not escape the output directory
+	if !filepath.IsLocal(f.path) {
+		return fmt.Errorf("invalid file name '%s', outside of the output directory", f.path)
+	}
+	finalPath := filepath.Join(dst, f.path)
+	err := os.MkdirAll(filepath.Dir(finalPath), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	// the file is downloaded with a hidden name, so incomplete files are never picked up by the go tools
+	localPath := filepath.Join(filepath.Dir(finalPath), "."+filepath.Base(finalPath)+".partial")
+
+	var lastErr error
+	for attempt := 0; attempt <= c.opts.Retries; attempt++ {
+		if attempt > 0 {
+			delay := copyRetryDelay << (attempt - 1)
+			logger(ctx).Debug("copy retry", "file", f.path, "attempt", attempt, "delay", delay, "error", lastErr)
+
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(delay):
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		lastErr = c.transferFile(ctx, f.path, localPath, progress)
+		if lastErr != nil {
+			// the partial file is kept, the next attempt will resume from its size
+			continue
+		}
+
+		checksum, err := fileChecksum(localPath)
+		if err != nil {
+			return err
+		}
+
+		if checksum == f.checksum {
+			return os.Rename(localPath, finalPath)
+		}
+
+		// corrupted file, start again from scratch
+		lastErr = fmt.Errorf("checksum mismatch: expected %s, got %s", f.checksum, checksum)
+		if err := os.Remove(localPath); err != nil {
+			return err
+		}
+		progress.Reset(f.path)
+	}
+
+	return fmt.Errorf("error copying '%s' after %d retries: %w", f.path, c.opts.Retries, lastErr)
+}
+
+// transferFile appends the remote file content to the local file, starting from the local file size
+func (c *Copier) transferFile(ctx context.Context, name, localPath string, progress *copyProgress) error {
+	out, err := os.OpenFile(localPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	info, err := out.Stat()
+	if err != nil {
+		return err
+	}
+	progress.Set(name, info.Size())
+
+	content, err := c.source.Open(ctx, name, info.Size(), c.opts.Compress)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	var reader io.Reader = content
+	if c.opts.Compress {
+		gz, err := gzip.NewReader(content)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		reader = gz
+	}
+
+	_, err = io.Copy(&progressWriter{w: out, name: name, progress: progress}, reader)
+	return err
+}
+
+func fileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+type progressWriter struct {
+	w        io.Writer
+	name     string
+	progress *copyProgress
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.progress.Add(w.name, int64(n))
+	return n, err
+}
+
+// copyProgress shows a progress bar with the bytes transferred
+type copyProgress struct {
+	mu      sync.Mutex
+	spinner *spinner.Spinner
+	start   time.Time
+	archive bool
+	files   int
+	total   int64
+	done    int64
+	perFile map[string]int64
+}
+
+func newCopyProgress(ctx context.Context, files []remoteFile) *copyProgress {
+	var total int64
+	for _, f := range files {
+		total += f.size
+	}
+
+	return &copyProgress{
+		spinner: newSpinner(ctx),
+		files:   len(files),
+		total:   total,
+		perFile: map[string]int64{},
+	}
+}
+
+func (p *copyProgress) Start() {
+	p.start = time.Now()
+	p.update()
+	p.spinner.Start()
+}
+
+func (p *copyProgress) Stop() {
+	p.spinner.Stop()
+}
+
+func (p *copyProgress) Elapsed() time.Duration {
+	return time.Since(p.start).Round(time.Second)
+}
+
+// Set sets the bytes already transferred of a file
+func (p *copyProgress) Set(name string, n int64) {
+	p.mu.Lock()
+	p.done += n - p.perFile[name]
+	p.perFile[name] = n
+	p.mu.Unlock()
+	p.update()
+}
+
+func (p *copyProgress) Add(name string, n int64) {
+	p.mu.Lock()
+	p.done += n
+	p.perFile[name] += n
+	p.mu.Unlock()
+	p.update()
+}
+
+func (p *copyProgress) Reset(name string) {
+	p.Set(name, 0)
+}
+
+func (p *copyProgress) update() {
+	p.mu.Lock()
+	done, total := p.done, p.total
+	p.mu.Unlock()
+
+	const width = 20
+	filled := width
+	if total > 0 {
+		filled = int(min(done, total) * width / total)
+	}
+	bar := strings.Repeat("#", filled) + strings.Repeat("-", width-filled)
+
+	suffix := fmt.Sprintf(" Copying %d files [%s] %s/%s", p.files, bar, formatBytes(done), formatBytes(total))
+	// the size of the archive is not known in advance
+	if p.archive {
+		suffix = fmt.Sprintf(" Downloading archive %s", formatBytes(done))
+	}
+
+	p.spinner.Lock()
+	p.spinner.Suffix = suffix
+	p.spinner.Unlock()
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
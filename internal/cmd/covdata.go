@@ -0,0 +1,199 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// profileFile is the text profile written next to the merged coverage data
+const profileFile = "coverage.out"
+
+// checkGoToolchain returns an error if the go toolchain, needed to process the coverage data, is not available
+func checkGoToolchain() error {
+	_, err := exec.LookPath("go")
+	if err != nil {
+		return errors.New("the 'go' toolchain is needed to process the coverage data, but it was not found in PATH")
+	}
+	return nil
+}
+
+// mergeCoverage merges the coverage data of the inputDirs into outDir, replacing its content
+func mergeCoverage(ctx context.Context, outDir string, inputDirs ...string) error {
+	return mergeCoverageArgs(ctx, outDir, inputDirs)
+}
+
+// combineCoverage merges the coverage data of different binaries, combining the packages they share
+func combineCoverage(ctx context.Context, outDir string, inputDirs ...string) error {
+	return mergeCoverageArgs(ctx, outDir, inputDirs, "-pcombine")
+}
+
+func mergeCoverageArgs(ctx context.Context, outDir string, inputDirs []string, args ...string) error {
+	tmpDir := outDir + ".tmp"
+	err := os.RemoveAll(tmpDir)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(tmpDir, os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	args = append([]string{"tool", "covdata", "merge", "-i", strings.Join(inputDirs, ","), "-o", tmpDir}, args...)
+	_, err = goTool(ctx, nil, args...)
+	if err != nil {
+		return err
+	}
+
+	err = os.RemoveAll(outDir)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpDir, outDir)
+}
+
+// WriteProfile merges the coverage data collected in the dir and writes it as a text profile, reporting the coverage percentage.
+// The files of the profile are mapped to the local sources, warning about the ones not found.
+func WriteProfile(ctx context.Context, dir, profile string, pathMap PathMapOptions) error {
+	err := checkGoToolchain()
+	if err != nil {
+		return err
+	}
+
+	mapper, err := newPathMapper(ctx, pathMap)
+	if err != nil {
+		return err
+	}
+
+	tmpDir, err := os.MkdirTemp("", "gocoverkube-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	mergedDir := filepath.Join(tmpDir, "merged")
+	err = mergeCoverage(ctx, mergedDir, dir)
+	if err != nil {
+		return err
+	}
+
+	err = textProfile(ctx, mergedDir, profile, mapper)
+	if err != nil {
+		return err
+	}
+	mapper.warnUnresolved(ctx)
+
+	percent, err := profilePercent(profile)
+	if err != nil {
+		return err
+	}
+
+	report(ctx, Event{Resource: fmt.Sprintf("Profile '%s'", profile), Action: "report"}, "📈 Coverage %.1f%%, profile written at '%s'", percent, profile)
+	setResult(ctx, "coveragePercent", percent)
+	setResult(ctx, "profile", profile)
+
+	return nil
+}
+
+// textProfile converts the coverage data of the dir to the legacy text format, with the files mapped by the mapper
+func textProfile(ctx context.Context, dir, profile string, mapper *pathMapper) error {
+	_, err := goTool(ctx, nil, "tool", "covdata", "textfmt", "-i", dir, "-o", profile)
+	if err != nil {
+		return err
+	}
+	return mapper.rewriteProfile(profile)
+}
+
+// profileBlock is a block of statements of a text profile
+type profileBlock struct {
+	file    string
+	stmts   int64
+	covered bool
+}
+
+// profilePercent returns the percentage of statements covered in the text profile
+func profilePercent(profile string) (float64, error) {
+	blocks, err := readProfile(profile)
+	if err != nil {
+		return 0, err
+	}
+	return blocksPercent(blocks, nil), nil
+}
+
+// readProfile returns the blocks of the text profile by their position
+func readProfile(profile string) (map[string]profileBlock, error) {
+	f, err := os.Open(profile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// the same block can be listed more than once, for example by different binaries
+	blocks := map[string]profileBlock{}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "mode:") || line == "" {
+			continue
+		}
+
+		// name.go:line.column,line.column numberOfStatements count
+		fields := strings.Fields(line)
+		if len(fields) != 3 || !strings.Contains(fields[0], ":") {
+			return nil, fmt.Errorf("invalid profile line '%s'", line)
+		}
+
+		stmts, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid profile line '%s': %w", line, err)
+		}
+		count, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid profile line '%s': %w", line, err)
+		}
+
+		b := blocks[fields[0]]
+		b.file = fields[0][:strings.LastIndex(fields[0], ":")]
+		b.stmts = stmts
+		b.covered = b.covered || count > 0
+		blocks[fields[0]] = b
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return blocks, nil
+}
+
+func percentOf(covered, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(covered) * 100 / float64(total)
+}
+
+// goTool runs the go command with the additional environment variables, returning its stdout
+func goTool(ctx context.Context, env []string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, "go", args...)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if err != nil {
+		return "", fmt.Errorf("'go %s' failed: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
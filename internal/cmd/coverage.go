@@ -0,0 +1,149 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"time"
+
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	covMetaPrefix     = "covmeta."
+	covCountersPrefix = "covcounters."
+
+	covMetaPollInterval = 2 * time.Second
+)
+
+// ListCoverageMeta returns the coverage meta-data files already on the volume, to tell apart the ones written after init.
+// It returns an empty set if there is no volume yet, and nil if they can't be listed.
+func ListCoverageMeta(ctx context.Context, clientset kubernetes.Interface, config *rest.Config, namespace string) map[string]bool {
+	source, err := newCollectorSource(ctx, config, clientset, namespace)
+	if k8serrors.IsNotFound(err) {
+		_, err = clientset.CoreV1().PersistentVolumeClaims(namespace).Get(ctx, pvcName, metav1.GetOptions{})
+		if k8serrors.IsNotFound(err) {
+			return map[string]bool{}
+		}
+		return nil
+	}
+	if err != nil {
+		return nil
+	}
+	defer source.Close()
+
+	files, err := source.List(ctx)
+	if err != nil {
+		return nil
+	}
+	return coverageMeta(files)
+}
+
+// WaitForCoverageMeta waits until a coverage meta-data file not in before is written on the volume.
+// It is written when an instrumented binary starts, so if it doesn't appear the binary was probably not built with '-cover'.
+// The volume is shared by the targets of the namespace, and a binary already run doesn't write its meta-data again,
+// so it warns when it can't be told, and when no meta-data is written: the workload is instrumented anyway.
+// A nil before means that the files on the volume before init are unknown.
+func WaitForCoverageMeta(ctx context.Context, clientset kubernetes.Interface, config *rest.Config, namespace string, timeout time.Duration, before map[string]bool) error {
+	source, err := newCollectorSource(ctx, config, clientset, namespace)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	s := newSpinner(ctx)
+	s.Suffix = " Waiting for the coverage meta-data"
+	s.Start()
+
+	start := time.Now()
+
+	var meta map[string]bool
+	err = wait.PollImmediateWithContext(ctx, covMetaPollInterval, timeout, func(ctx context.Context) (bool, error) {
+		files, err := source.List(ctx)
+		if err != nil {
+			return false, err
+		}
+		meta = coverageMeta(files)
+
+		if before == nil {
+			return len(meta) > 0, nil
+		}
+		for file := range meta {
+			if !before[file] {
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+	s.Stop()
+
+	switch {
+	case errors.Is(err, wait.ErrWaitTimeout) && len(meta) > 0:
+		warn(ctx, "⚠️  No new coverage meta-data written on the volume after %v, it can't be told if the binary is built with '-cover': "+
+			"the volume has the meta-data of the other targets or of a previous run, see 'gocoverkube doctor'", timeout)
+		return nil
+	case errors.Is(err, wait.ErrWaitTimeout):
+		warn(ctx, "⚠️  No coverage meta-data written on the volume after %v, the binary is probably not built with '-cover', see 'gocoverkube doctor'", timeout)
+		return nil
+	case err != nil:
+		return err
+	case before == nil:
+		warn(ctx, "⚠️  Coverage meta-data found on the volume, but it can't be told if it was written by this binary, see 'gocoverkube doctor'")
+		return nil
+	}
+
+	elapsed := time.Since(start).Round(time.Second)
+	report(ctx, Event{Resource: pvcResource, Action: "wait", Duration: elapsed}, "✅ Coverage meta-data written [%v]", elapsed)
+	return nil
+}
+
+// coverageMeta returns the coverage meta-data files
+func coverageMeta(files []remoteFile) map[string]bool {
+	meta := map[string]bool{}
+	for _, f := range files {
+		if strings.HasPrefix(filepath.Base(f.path), covMetaPrefix) {
+			meta[f.path] = true
+		}
+	}
+	return meta
+}
+
+// checkCoverageFiles returns an error if there are no coverage counters in the files of the volume,
+// or in the ones already collected, since nothing would be reported
+// errNoCoverageCounters is returned when the volume has the meta-data of the binaries, but not their counters yet
+var errNoCoverageCounters = errors.New("no coverage counters found on the volume, they are written when the process exits: collect with '--restart'")
+
+func checkCoverageFiles(files []remoteFile, m *manifest) error {
+	paths := []string{}
+	for _, f := range files {
+		paths = append(paths, f.path)
+	}
+	if m != nil {
+		for path := range m.Files {
+			paths = append(paths, path)
+		}
+	}
+
+	switch {
+	case countPaths(paths, covMetaPrefix) == 0:
+		return errors.New("no coverage meta-data found on the volume, the binary is probably not built with '-cover', see 'gocoverkube doctor'")
+	case countPaths(paths, covCountersPrefix) == 0:
+		return errNoCoverageCounters
+	}
+	return nil
+}
+
+func countPaths(paths []string, prefix string) int {
+	n := 0
+	for _, path := range paths {
+		if strings.HasPrefix(filepath.Base(path), prefix) {
+			n++
+		}
+	}
+	return n
+}
@@ -2,23 +2,119 @@ package cmd
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
-	"github.com/briandowns/spinner"
 	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	appsv1ac "k8s.io/client-go/applyconfigurations/apps/v1"
+	corev1ac "k8s.io/client-go/applyconfigurations/core/v1"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
 )
 
-func updateAndRestartDeployment(
+const (
+	// fieldManager owns the fields injected in the workloads, and only them
+	fieldManager          = "gocoverkube"
+	restartedAtAnnotation = "kubectl.kubernetes.io/restartedAt"
+)
+
+// instrumentDeployment applies the coverage env var, volume and mount to the container of the deployment,
+// with a new restart annotation to restart it also if it was already instrumented, and the swapped image if any.
+// The fields owned by other managers are taken over only if forced.
+func instrumentDeployment(
 	ctx context.Context,
 	clientset kubernetes.Interface,
 	namespace string,
 	deployment *appsv1.Deployment,
+	container string,
+	swap imageSwap,
+	force bool,
 ) error {
-	deploymentClient := clientset.AppsV1().Deployments(namespace)
+	annotations := map[string]string{
+		restartedAtAnnotation: time.Now().Format(time.RFC3339),
+	}
+
+	containerConfig := corev1ac.Container().
+		WithName(container).
+		WithEnv(corev1ac.EnvVar().
+			WithName("GOCOVERDIR").
+			WithValue(mountPath)).
+		WithVolumeMounts(corev1ac.VolumeMount().
+			WithName(volumeName).
+			WithMountPath(mountPath))
+
+	if swap.image != "" {
+		containerConfig.WithImage(swap.image)
+		annotations[originalImageAnnotation] = swap.original
+	}
+
+	applyConfig := appsv1ac.Deployment(deployment.Name, namespace).
+		WithSpec(appsv1ac.DeploymentSpec().
+			WithTemplate(corev1ac.PodTemplateSpec().
+				WithAnnotations(annotations).
+				WithSpec(corev1ac.PodSpec().
+					WithContainers(containerConfig).
+					WithVolumes(corev1ac.Volume().
+						WithName(volumeName).
+						WithPersistentVolumeClaim(corev1ac.PersistentVolumeClaimVolumeSource().
+							WithClaimName(pvcName))))))
+
+	return rolloutDeployment(ctx, clientset, namespace, deployment, func(ctx context.Context) (*appsv1.Deployment, error) {
+		return applyDeployment(ctx, clientset, namespace, applyConfig, force)
+	})
+}
+
+// applyDeployment applies the configuration with the gocoverkube field manager, taking over the fields owned by
+// other managers only if forced. The fields owned by gocoverkube that are not in the configuration are removed.
+func applyDeployment(ctx context.Context, clientset kubernetes.Interface, namespace string, applyConfig *appsv1ac.DeploymentApplyConfiguration, force bool) (*appsv1.Deployment, error) {
+	applied, err := clientset.AppsV1().Deployments(namespace).Apply(ctx, applyConfig, metav1.ApplyOptions{
+		FieldManager: fieldManager,
+		Force:        force,
+	})
+	if k8serrors.IsConflict(err) {
+		return nil, applyConflictError(err)
+	}
+	return applied, err
+}
+
+// applyConflictError lists the fields of the apply conflict with the managers owning them
+func applyConflictError(err error) error {
+	var status k8serrors.APIStatus
+	if !errors.As(err, &status) || status.Status().Details == nil {
+		return err
+	}
+
+	conflicts := []string{}
+	for _, cause := range status.Status().Details.Causes {
+		if cause.Type != metav1.CauseTypeFieldManagerConflict {
+			continue
+		}
+		// the message is 'conflict with "manager" using apps/v1'
+		conflicts = append(conflicts, fmt.Sprintf("\n   %s: %s", cause.Field, cause.Message))
+	}
+	if len(conflicts) == 0 {
+		return err
+	}
+
+	return fmt.Errorf("fields owned by other managers, take them over with '--force-conflicts':%s", strings.Join(conflicts, ""))
+}
 
+// rolloutDeployment changes the deployment and waits for its rollout
+func rolloutDeployment(
+	ctx context.Context,
+	clientset kubernetes.Interface,
+	namespace string,
+	deployment *appsv1.Deployment,
+	change func(ctx context.Context) (*appsv1.Deployment, error),
+) error {
 	selector, err := metav1.LabelSelectorAsSelector(deployment.Spec.Selector)
 	if err != nil {
 		return err
@@ -35,47 +131,158 @@ func updateAndRestartDeployment(
 		oldPods[p.Name] = struct{}{}
 	}
 
-	// update 'restartedAt' annotation to force restart
-	objectMeta := deployment.Spec.Template.ObjectMeta
-	if objectMeta.Annotations == nil {
-		objectMeta.Annotations = make(map[string]string)
-	}
-	objectMeta.Annotations["kubectl.kubernetes.io/restartedAt"] = time.Now().Format(time.RFC3339)
-	deployment.Spec.Template.ObjectMeta = objectMeta
-
-	_, err = deploymentClient.Update(ctx, deployment, metav1.UpdateOptions{})
+	updated, err := change(ctx)
 	if err != nil {
 		return err
 	}
 
-	s := spinner.New(spinner.CharSets[9], 100*time.Millisecond) // Build our new spinner
+	resource := fmt.Sprintf("Deployment '%s'", deployment.Name)
+	trackResource(ctx, resource, "updated, rollout in progress")
+
+	s := newSpinner(ctx)
 
 	s.Suffix = " Updating Deployment"
 	s.Start()
 
 	start := time.Now()
-	for {
-		pods, err := podClient.List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
-		if err != nil {
-			return err
-		}
+	err = waitForRollout(ctx, clientset, namespace, updated, oldPods, func(status string) {
+		s.Lock()
+		s.Suffix = " Updating Deployment: " + status
+		s.Unlock()
+	})
+	s.Stop()
+	if err != nil {
+		return err
+	}
+	trackResource(ctx, resource, "rolled out")
+
+	elapsed := time.Since(start).Round(time.Second)
+	report(ctx, Event{Resource: resource, Action: "restart", Duration: elapsed}, "✅ Deployment restarted [%v]", elapsed)
+	return nil
+}
+
+// waitForRollout waits for the rollout of the deployment like 'kubectl rollout status', failing fast if one of the new pods will never start.
+// The progress function is called with a description of the rollout status.
+func waitForRollout(
+	ctx context.Context,
+	clientset kubernetes.Interface,
+	namespace string,
+	deployment *appsv1.Deployment,
+	oldPods map[string]struct{},
+	progress func(status string),
+) error {
+	selector, err := metav1.LabelSelectorAsSelector(deployment.Spec.Selector)
+	if err != nil {
+		return err
+	}
+	podListOptions := metav1.ListOptions{LabelSelector: selector.String()}
+
+	rolloutCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-		oldPodFound := false
-		for _, p := range pods.Items {
-			if _, found := oldPods[p.Name]; found {
-				oldPodFound = true
-				break
+	// watch the new pods in background, returning only if one of them fails
+	podFailed := make(chan error, 1)
+	go func() {
+		defer close(podFailed)
+
+		err := waitForPods(WithWaitTimeout(rolloutCtx, 0), clientset, namespace, podListOptions, func(pods []*v1.Pod) (bool, error) {
+			for _, p := range pods {
+				if _, found := oldPods[p.Name]; found {
+					continue
+				}
+				if err := podFailure(p); err != nil {
+					return false, err
+				}
 			}
+			return false, nil
+		})
+
+		if rolloutCtx.Err() == nil {
+			podFailed <- err
+			cancel()
+		}
+	}()
+
+	deploymentClient := clientset.AppsV1().Deployments(namespace)
+	lw := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", deployment.Name).String()
+			return deploymentClient.List(ctx, options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", deployment.Name).String()
+			return deploymentClient.Watch(ctx, options)
+		},
+	}
+
+	err = waitFor(rolloutCtx, lw, &appsv1.Deployment{}, func(objs []runtime.Object) (bool, error) {
+		if len(objs) == 0 {
+			return false, fmt.Errorf("deployment '%s' not found", deployment.Name)
 		}
 
-		if !oldPodFound {
-			break
+		status, done, err := rolloutStatus(objs[0].(*appsv1.Deployment), deployment.Generation)
+		if err == nil {
+			progress(status)
 		}
+		return done, err
+	})
+	cancel()
 
-		time.Sleep(time.Second)
+	if failure := <-podFailed; failure != nil {
+		return fmt.Errorf("rollout of deployment '%s' failed: %w", deployment.Name, failure)
+	}
+	if err == nil || ctx.Err() != nil {
+		return err
 	}
-	s.Stop()
 
-	fmt.Printf("✅ Deployment restarted [%v]\n", time.Since(start).Round(time.Second))
-	return nil
+	err = fmt.Errorf("rollout of deployment '%s' failed: %w", deployment.Name, err)
+
+	// attach the events and the logs of the new pods that are not ready
+	listCtx, cancelList := diagnosticsContext(ctx)
+	defer cancelList()
+	pods, listErr := clientset.CoreV1().Pods(namespace).List(listCtx, podListOptions)
+	if listErr != nil {
+		return err
+	}
+
+	newPods := []*v1.Pod{}
+	for i := range pods.Items {
+		if _, found := oldPods[pods.Items[i].Name]; !found {
+			newPods = append(newPods, &pods.Items[i])
+		}
+	}
+
+	return fmt.Errorf("%w%s", err, diagnosePods(ctx, clientset, namespace, newPods))
+}
+
+// rolloutStatus returns the status of the rollout of the deployment, and if it is completed.
+// It follows the same logic of 'kubectl rollout status'.
+func rolloutStatus(deployment *appsv1.Deployment, generation int64) (string, bool, error) {
+	status := deployment.Status
+
+	if status.ObservedGeneration < generation {
+		return "waiting for the deployment spec update to be observed", false, nil
+	}
+
+	for _, c := range status.Conditions {
+		if c.Type == appsv1.DeploymentProgressing && c.Reason == "ProgressDeadlineExceeded" {
+			return "", false, fmt.Errorf("deployment '%s' exceeded its progress deadline: %s", deployment.Name, c.Message)
+		}
+	}
+
+	replicas := int32(1)
+	if deployment.Spec.Replicas != nil {
+		replicas = *deployment.Spec.Replicas
+	}
+
+	switch {
+	case status.UpdatedReplicas < replicas:
+		return fmt.Sprintf("%d of %d new replicas have been updated", status.UpdatedReplicas, replicas), false, nil
+	case status.Replicas > status.UpdatedReplicas:
+		return fmt.Sprintf("%d old replicas are pending termination", status.Replicas-status.UpdatedReplicas), false, nil
+	case status.AvailableReplicas < status.UpdatedReplicas:
+		return fmt.Sprintf("%d of %d updated replicas are available", status.AvailableReplicas, status.UpdatedReplicas), false, nil
+	}
+
+	return "rollout completed", true, nil
 }
@@ -0,0 +1,167 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	diagnosticsTimeout = 10 * time.Second
+	diagnosticsEvents  = 5
+	diagnosticsLogs    = int64(20)
+	// maxDiagnosedPods limits the pods whose events and logs are attached to an error
+	maxDiagnosedPods = 2
+	// unboundClaimGracePeriod is the time given to the PVCs of a pending pod to be provisioned and bound
+	unboundClaimGracePeriod = time.Minute
+)
+
+// terminalWaitingReasons are the container waiting reasons that won't resolve without a change to the pod.
+// A failed image pull is retried, it's terminal only once it's backing off.
+var terminalWaitingReasons = map[string]bool{
+	"CrashLoopBackOff":           true,
+	"ImagePullBackOff":           true,
+	"InvalidImageName":           true,
+	"CreateContainerConfigError": true,
+	"CreateContainerError":       true,
+	"RunContainerError":          true,
+}
+
+// podFailure returns an error if the pod is in a state it won't recover from
+func podFailure(pod *v1.Pod) error {
+	if pod.Status.Phase == v1.PodFailed {
+		return fmt.Errorf("pod '%s' failed: %s", pod.Name, pod.Status.Reason)
+	}
+
+	if message, since, unbound := unboundClaim(pod); unbound && time.Since(since) > unboundClaimGracePeriod {
+		return fmt.Errorf("pod '%s' is pending, its PersistentVolumeClaims are not bound: %s", pod.Name, message)
+	}
+
+	statuses := append([]v1.ContainerStatus{}, pod.Status.InitContainerStatuses...)
+	statuses = append(statuses, pod.Status.ContainerStatuses...)
+
+	for _, cs := range statuses {
+		if cs.State.Waiting != nil && terminalWaitingReasons[cs.State.Waiting.Reason] {
+			return fmt.Errorf(
+				"container '%s' of pod '%s' is in %s: %s",
+				cs.Name, pod.Name, cs.State.Waiting.Reason, cs.State.Waiting.Message,
+			)
+		}
+	}
+
+	return nil
+}
+
+// unboundClaim returns true if the pod can't be scheduled because of an unbound PVC,
+// with the message of the scheduler and the time since when it's unschedulable
+func unboundClaim(pod *v1.Pod) (string, time.Time, bool) {
+	if pod.Status.Phase != v1.PodPending {
+		return "", time.Time{}, false
+	}
+
+	for _, c := range pod.Status.Conditions {
+		// i.e. 'pod has unbound immediate PersistentVolumeClaims'
+		if c.Type == v1.PodScheduled && c.Status == v1.ConditionFalse && c.Reason == v1.PodReasonUnschedulable &&
+			strings.Contains(c.Message, "unbound") {
+			return c.Message, c.LastTransitionTime.Time, true
+		}
+	}
+	return "", time.Time{}, false
+}
+
+// diagnosePods returns the diagnostics of the first pods that are not ready
+func diagnosePods(ctx context.Context, clientset kubernetes.Interface, namespace string, pods []*v1.Pod) string {
+	var sb strings.Builder
+
+	diagnosed := 0
+	for _, pod := range pods {
+		if ready, _ := podReady(pod); ready || diagnosed == maxDiagnosedPods {
+			continue
+		}
+		// the wait could have ended within the grace period
+		if message, _, unbound := unboundClaim(pod); unbound {
+			fmt.Fprintf(&sb, "\n  pod '%s' is pending, its PersistentVolumeClaims are not bound: %s", pod.Name, message)
+		}
+		sb.WriteString(podDiagnostics(ctx, clientset, namespace, pod.Name))
+		diagnosed++
+	}
+
+	return sb.String()
+}
+
+// diagnosticsContext returns a context for the diagnostics of a failed wait, with the values of ctx but not its cancellation,
+// since the one of the failed wait could be already expired
+func diagnosticsContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.WithoutCancel(ctx), diagnosticsTimeout)
+}
+
+// podDiagnostics returns the latest events and container logs of the pod, to be attached to an error
+func podDiagnostics(ctx context.Context, clientset kubernetes.Interface, namespace, podName string) string {
+	ctx, cancel := diagnosticsContext(ctx)
+	defer cancel()
+
+	var sb strings.Builder
+
+	events, err := clientset.CoreV1().Events(namespace).List(ctx, metav1.ListOptions{
+		FieldSelector: fields.Set{
+			"involvedObject.kind": "Pod",
+			"involvedObject.name": podName,
+		}.AsSelector().String(),
+	})
+	if err == nil && len(events.Items) > 0 {
+		items := events.Items
+		sort.Slice(items, func(i, j int) bool {
+			return eventTime(items[i]).Before(eventTime(items[j]))
+		})
+		if len(items) > diagnosticsEvents {
+			items = items[len(items)-diagnosticsEvents:]
+		}
+
+		fmt.Fprintf(&sb, "\n  events of pod '%s':", podName)
+		for _, e := range items {
+			fmt.Fprintf(&sb, "\n    %s\t%s\t%s", e.Type, e.Reason, e.Message)
+		}
+	}
+
+	pod, err := clientset.CoreV1().Pods(namespace).Get(ctx, podName, metav1.GetOptions{})
+	if err != nil {
+		return sb.String()
+	}
+
+	for _, cs := range pod.Status.ContainerStatuses {
+		tailLines := diagnosticsLogs
+		logs, err := clientset.CoreV1().Pods(namespace).GetLogs(podName, &v1.PodLogOptions{
+			Container: cs.Name,
+			TailLines: &tailLines,
+			// the logs of the crashed container are more useful than the ones of the restarting one
+			Previous: cs.RestartCount > 0,
+		}).DoRaw(ctx)
+		if err != nil || len(logs) == 0 {
+			continue
+		}
+
+		fmt.Fprintf(&sb, "\n  last logs of container '%s':", cs.Name)
+		for _, line := range strings.Split(strings.TrimRight(string(logs), "\n"), "\n") {
+			fmt.Fprintf(&sb, "\n    %s", line)
+		}
+	}
+
+	return sb.String()
+}
+
+func eventTime(e v1.Event) time.Time {
+	if !e.LastTimestamp.IsZero() {
+		return e.LastTimestamp.Time
+	}
+	if !e.EventTime.IsZero() {
+		return e.EventTime.Time
+	}
+	return e.CreationTimestamp.Time
+}
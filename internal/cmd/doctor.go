@@ -0,0 +1,346 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/version"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	checkSuccess = "success"
+	checkWarning = "warning"
+	checkError   = "error"
+)
+
+// coverageMarker is a string of the coverage runtime, linked only in the binaries built with '-cover'
+const coverageMarker = "covcounters"
+
+// DoctorOptions are the checks run by Doctor
+type DoctorOptions struct {
+	Namespace string
+	// Collector is the collector pod that is tried with a dry-run against the Pod Security admission
+	Collector CollectorOptions
+	// Targets are the workloads whose binary is checked for the coverage instrumentation
+	Targets []DoctorTarget
+}
+
+// DoctorTarget is a workload whose binary is checked for the coverage instrumentation
+type DoctorTarget struct {
+	Namespace  string
+	Deployment string
+	Pod        string
+	// Container is the container to check, the instrumented one or the first one if empty
+	Container string
+}
+
+// doctor reports the result of the checks, with the fixes of the failed ones
+type doctor struct {
+	ctx    context.Context
+	failed int
+}
+
+func (d *doctor) check(check, result, fix, format string, args ...any) {
+	icon := "✅"
+	switch result {
+	case checkWarning:
+		icon = "⚠️ "
+	case checkError:
+		icon = "❌"
+		d.failed++
+	}
+
+	message := fmt.Sprintf(format, args...)
+	if fix != "" {
+		message += "\n   👉 " + fix
+	}
+	report(d.ctx, Event{Resource: check, Action: "check", Result: result}, "%s %s", icon, message)
+}
+
+// Doctor checks the environment needed by gocoverkube: the connection to the cluster returned by connect,
+// the storage classes, the Pod Security admission of the namespace, the instrumentation of the targets and the local go toolchain.
+// It returns an error if any check failed.
+func Doctor(ctx context.Context, connect func() (kubernetes.Interface, *rest.Config, error), opts DoctorOptions) error {
+	d := &doctor{ctx: ctx}
+
+	var serverVersion *version.Info
+	clientset, config, err := connect()
+	if err == nil {
+		serverVersion, err = ServerVersion(clientset)
+	}
+	if err != nil {
+		fix := "check the '--kubeconfig' and '--context' flags, or run it in a Pod with a ServiceAccount"
+		if k8serrors.IsUnauthorized(err) {
+			fix = "the credentials of the current context were rejected, log in to the cluster again"
+		}
+		d.check("cluster", checkError, fix, "Unable to connect to the cluster: %s", err)
+	} else {
+		d.check("cluster", checkSuccess, "", "Connected to %s, Kubernetes %s", config.Host, serverVersion.GitVersion)
+
+		d.checkStorageClasses(clientset)
+		d.checkPodSecurity(clientset, opts.Namespace, opts.Collector)
+		for _, target := range opts.Targets {
+			d.checkInstrumentation(clientset, config, target)
+		}
+	}
+
+	d.checkGoToolchain()
+
+	if d.failed > 0 {
+		return fmt.Errorf("%d checks failed", d.failed)
+	}
+	return nil
+}
+
+func (d *doctor) checkStorageClasses(clientset kubernetes.Interface) {
+	storageClasses, err := clientset.StorageV1().StorageClasses().List(d.ctx, metav1.ListOptions{})
+	if err != nil {
+		d.check("storage", checkWarning, "grant 'list' on 'storageclasses', see 'gocoverkube rbac init'",
+			"Unable to list the storage classes: %s", err)
+		return
+	}
+
+	if len(storageClasses.Items) == 0 {
+		d.check("storage", checkError, "install a storage provisioner, the coverage is written to a PersistentVolumeClaim",
+			"No storage classes found")
+		return
+	}
+
+	hasDefault := false
+	for _, sc := range storageClasses.Items {
+		isDefault := sc.Annotations["storageclass.kubernetes.io/is-default-class"] == "true"
+		hasDefault = hasDefault || isDefault
+
+		bindingMode := storagev1.VolumeBindingImmediate
+		if sc.VolumeBindingMode != nil {
+			bindingMode = *sc.VolumeBindingMode
+		}
+
+		name := sc.Name
+		if isDefault {
+			name += " (default)"
+		}
+		d.check("storage", checkSuccess, "", "Storage class '%s', provisioner '%s', binding mode %s", name, sc.Provisioner, bindingMode)
+	}
+
+	if !hasDefault {
+		d.check("storage", checkWarning, "mark a storage class as default, or choose one with 'init --storage-class'",
+			"No default storage class")
+	}
+}
+
+func (d *doctor) checkPodSecurity(clientset kubernetes.Interface, namespace string, collector CollectorOptions) {
+	ns, err := clientset.CoreV1().Namespaces().Get(d.ctx, namespace, metav1.GetOptions{})
+	if err != nil {
+		d.check("pod-security", checkWarning, "", "Unable to read the Pod Security labels of namespace '%s': %s", namespace, err)
+	} else {
+		level := ns.Labels["pod-security.kubernetes.io/enforce"]
+		if level == "" {
+			level = "not set"
+		}
+		d.check("pod-security", checkSuccess, "", "Pod Security enforce level of namespace '%s': %s", namespace, level)
+	}
+
+	// the admission of the collector pod is tried with a dry-run, that doesn't create anything
+	pod := newCollectorPod(collector, nil)
+	pod.Name = ""
+	pod.GenerateName = collectorName + "-doctor-"
+
+	_, err = clientset.CoreV1().Pods(namespace).Create(d.ctx, pod, metav1.CreateOptions{DryRun: []string{metav1.DryRunAll}})
+	switch {
+	case err == nil:
+		d.check("pod-security", checkSuccess, "", "The collector pod is admitted in namespace '%s'", namespace)
+	case k8serrors.IsForbidden(err) && strings.Contains(err.Error(), "PodSecurity"):
+		d.check("pod-security", checkError,
+			"run the collector as non-root with the '--collector-run-as-*' flags, or relax the 'pod-security.kubernetes.io/enforce' label of the namespace",
+			"The collector pod is rejected in namespace '%s': %s", namespace, err)
+	default:
+		d.check("pod-security", checkWarning, "", "Unable to try the collector pod in namespace '%s': %s", namespace, err)
+	}
+}
+
+func (d *doctor) checkInstrumentation(clientset kubernetes.Interface, config *rest.Config, target DoctorTarget) {
+	resource := fmt.Sprintf("pod '%s/%s'", target.Namespace, target.Pod)
+	if target.Deployment != "" {
+		resource = fmt.Sprintf("deployment '%s/%s'", target.Namespace, target.Deployment)
+	}
+
+	pod, err := targetPod(d.ctx, clientset, target)
+	if err != nil {
+		d.check("binary", checkWarning, "", "Unable to check the binary of %s: %s", resource, err)
+		return
+	}
+
+	container := target.Container
+	if container == "" {
+		container = pod.Spec.Containers[0].Name
+		if name, found := instrumentedContainer(pod.Spec); found {
+			container = name
+		}
+	}
+
+	// the images built by gocoverkube are labelled with the packages whose coverage is recorded
+	image, labels, labelsErr := imageLabels(d.ctx, pod, container)
+	if coverPkgs := labels[ImageLabelCoverPkg]; coverPkgs != "" {
+		d.check("binary", checkSuccess, "", "The image '%s' of container '%s' of %s is built with '-cover', recording %d packages",
+			image, container, resource, len(strings.Split(coverPkgs, ",")))
+		return
+	}
+
+	// otherwise the binary is the executable of the first process of the container, if it can be read
+	source := &execSource{restConfig: config, clientset: clientset, namespace: pod.Namespace, pod: pod.Name, container: container}
+	marker := &markerWriter{marker: []byte(coverageMarker)}
+	err = source.exec(d.ctx, []string{"cat", "/proc/1/exe"}, marker)
+
+	switch {
+	case marker.found:
+		d.check("binary", checkSuccess, "", "The binary of container '%s' of %s is built with '-cover'", container, resource)
+	case err != nil:
+		labelsReason := "it has no gocoverkube labels"
+		if labelsErr != nil {
+			labelsReason = labelsErr.Error()
+		}
+		d.check("binary", checkWarning, "make sure the binary is built with 'go build -cover', or build the image with 'gocoverkube build'",
+			"Unable to check the binary of container '%s' of %s: the labels of the image '%s' can't be read (%s), "+
+				"and the binary can't be read with 'cat /proc/1/exe' in the container, i.e. in a distroless or scratch image: %s",
+			container, resource, image, labelsReason, err)
+	default:
+		d.check("binary", checkError, "build the binary with 'go build -cover', no coverage is written otherwise. "+
+			"If the first process of the container is a shell or an init wrapper, build the image with 'gocoverkube build' to check its labels instead",
+			"The binary of container '%s' of %s is not built with '-cover'", container, resource)
+	}
+}
+
+// imageLabels returns the image of the container, as pulled if known, with the labels of its config read from the registry
+func imageLabels(ctx context.Context, pod *v1.Pod, container string) (string, map[string]string, error) {
+	image := ""
+	for _, c := range pod.Spec.Containers {
+		if c.Name == container {
+			image = c.Image
+		}
+	}
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.Name != container {
+			continue
+		}
+		// the image ID is the digest of the pulled image, with the 'docker-pullable://' scheme on older runtimes
+		imageID := status.ImageID
+		if _, digest, found := strings.Cut(imageID, "://"); found {
+			imageID = digest
+		}
+		if strings.Contains(imageID, "@") {
+			image = imageID
+		}
+	}
+
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return image, nil, err
+	}
+
+	img, err := remote.Image(ref, remote.WithContext(ctx), remote.WithAuthFromKeychain(authn.DefaultKeychain))
+	if err != nil {
+		return image, nil, err
+	}
+
+	configFile, err := img.ConfigFile()
+	if err != nil {
+		return image, nil, err
+	}
+	return image, configFile.Config.Labels, nil
+}
+
+// targetPod returns the pod, or a running pod of the deployment
+func targetPod(ctx context.Context, clientset kubernetes.Interface, target DoctorTarget) (*v1.Pod, error) {
+	if target.Pod != "" {
+		return clientset.CoreV1().Pods(target.Namespace).Get(ctx, target.Pod, metav1.GetOptions{})
+	}
+
+	deployment, err := clientset.AppsV1().Deployments(target.Namespace).Get(ctx, target.Deployment, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	selector, err := metav1.LabelSelectorAsSelector(deployment.Spec.Selector)
+	if err != nil {
+		return nil, err
+	}
+
+	pods, err := clientset.CoreV1().Pods(target.Namespace).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, err
+	}
+	for _, pod := range pods.Items {
+		if pod.Status.Phase == v1.PodRunning && pod.DeletionTimestamp == nil {
+			return &pod, nil
+		}
+	}
+
+	return nil, errors.New("no running pods")
+}
+
+func (d *doctor) checkGoToolchain() {
+	err := checkGoToolchain()
+	if err != nil {
+		d.check("toolchain", checkWarning, "install Go 1.20 or later to merge the coverage and write the reports", "%s", err)
+		return
+	}
+
+	out, err := exec.Command("go", "env", "GOVERSION").Output()
+	if err != nil {
+		d.check("toolchain", checkWarning, "", "Unable to get the version of the go toolchain: %s", err)
+		return
+	}
+
+	version := strings.TrimSpace(string(out))
+	// the covdata tool was added in Go 1.20
+	minor, _, _ := strings.Cut(strings.TrimPrefix(version, "go1."), ".")
+	if n, err := strconv.Atoi(minor); err == nil && n < 20 {
+		d.check("toolchain", checkError, "install Go 1.20 or later to merge the coverage and write the reports",
+			"The go toolchain %s doesn't support the coverage data files", version)
+		return
+	}
+
+	d.check("toolchain", checkSuccess, "", "Go toolchain %s found, for the reports", version)
+}
+
+// markerWriter looks for the marker in the written bytes, stopping the stream once found
+type markerWriter struct {
+	marker []byte
+	tail   []byte
+	found  bool
+}
+
+func (w *markerWriter) Write(p []byte) (int, error) {
+	if w.found {
+		return 0, errors.New("marker found")
+	}
+
+	// the marker can be split between two writes
+	buf := append(w.tail, p...)
+	if bytes.Contains(buf, w.marker) {
+		w.found = true
+		return 0, errors.New("marker found")
+	}
+
+	keep := len(w.marker) - 1
+	if len(buf) > keep {
+		buf = buf[len(buf)-keep:]
+	}
+	w.tail = append([]byte{}, buf...)
+
+	return len(p), nil
+}
@@ -0,0 +1,272 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// orphan is a gocoverkube resource that is not used anymore
+type orphan struct {
+	kind      string
+	namespace string
+	name      string
+	reason    string
+	delete    func(ctx context.Context) error
+}
+
+// GC deletes the gocoverkube resources left behind in the namespace, or in all the namespaces if empty:
+// the sessions whose targets are not instrumented anymore, the resources not owned by any session and the expired locks.
+// The namespaces locked by a running invocation are skipped.
+func GC(ctx context.Context, clientset kubernetes.Interface, namespace string, dryRun bool) error {
+	listOptions := metav1.ListOptions{
+		LabelSelector: managedByLabel + "=" + managedByValue,
+	}
+
+	leases, err := clientset.CoordinationV1().Leases(namespace).List(ctx, listOptions)
+	if err != nil {
+		return err
+	}
+
+	orphans := []orphan{}
+	locked := map[string]bool{}
+
+	for _, lease := range leases.Items {
+		// the lease can't be observed over time here, so its renew time is trusted with a tolerance for the clock skew
+		if lease.Spec.RenewTime != nil && time.Now().Before(lease.Spec.RenewTime.Add(leaseDuration(&lease)+lockDuration)) {
+			locked[lease.Namespace] = true
+			report(ctx, Event{Action: "skip", Result: "skipped"}, "ℹ️  Skipping namespace '%s', locked by '%s'", lease.Namespace, holder(&lease))
+			continue
+		}
+
+		leaseClient := clientset.CoordinationV1().Leases(lease.Namespace)
+		name, version := lease.Name, lease.ResourceVersion
+		orphans = append(orphans, orphan{
+			kind: "Lease", namespace: lease.Namespace, name: name, reason: "expired",
+			delete: func(ctx context.Context) error {
+				// not if it was renewed in the meantime
+				return leaseClient.Delete(ctx, name, metav1.DeleteOptions{
+					Preconditions: &metav1.Preconditions{ResourceVersion: &version},
+				})
+			},
+		})
+	}
+
+	sessions, err := clientset.CoreV1().ConfigMaps(namespace).List(ctx, listOptions)
+	if err != nil {
+		return err
+	}
+
+	// namespaces with a session in use, whose unowned resources are considered part of it
+	inUse := map[string]bool{}
+
+	for _, session := range sessions.Items {
+		if locked[session.Namespace] || session.Name != sessionName {
+			continue
+		}
+
+		instrumented, err := anyInstrumented(ctx, clientset, session.Namespace, sessionTargets(&session))
+		if err != nil {
+			return err
+		}
+		if instrumented {
+			inUse[session.Namespace] = true
+			continue
+		}
+
+		ns := session.Namespace
+		orphans = append(orphans, orphan{
+			kind: "ConfigMap", namespace: ns, name: session.Name,
+			reason: fmt.Sprintf("session of '%s', not instrumented anymore", strings.Join(sessionTargets(&session), "', '")),
+			delete: func(ctx context.Context) error {
+				return deleteSession(ctx, clientset, ns)
+			},
+		})
+	}
+
+	// the resources from before the sessions have no owner, they are kept while any workload of the namespace is instrumented
+	instrumented := map[string]bool{}
+	unowned := func(kind string, meta metav1.ObjectMeta, delete func(ctx context.Context) error) error {
+		if locked[meta.Namespace] || inUse[meta.Namespace] || len(meta.OwnerReferences) > 0 {
+			return nil
+		}
+
+		inNamespace, checked := instrumented[meta.Namespace]
+		if !checked {
+			targets, err := instrumentedWorkloads(ctx, clientset, meta.Namespace)
+			if err != nil {
+				return err
+			}
+			inNamespace = len(targets) > 0
+			instrumented[meta.Namespace] = inNamespace
+			if inNamespace {
+				report(ctx, Event{Action: "skip", Result: "skipped"}, "ℹ️  Skipping the resources without a session in namespace '%s', '%s' still instrumented", meta.Namespace, strings.Join(targets, "', '"))
+			}
+		}
+		if inNamespace {
+			return nil
+		}
+
+		orphans = append(orphans, orphan{
+			kind: kind, namespace: meta.Namespace, name: meta.Name, reason: "not owned by any session",
+			delete: delete,
+		})
+		return nil
+	}
+
+	pods, err := clientset.CoreV1().Pods(namespace).List(ctx, listOptions)
+	if err != nil {
+		return err
+	}
+	for _, pod := range pods.Items {
+		podClient := clientset.CoreV1().Pods(pod.Namespace)
+		name := pod.Name
+		err := unowned("Pod", pod.ObjectMeta, func(ctx context.Context) error {
+			return podClient.Delete(ctx, name, metav1.DeleteOptions{})
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	secrets, err := clientset.CoreV1().Secrets(namespace).List(ctx, listOptions)
+	if err != nil {
+		return err
+	}
+	for _, secret := range secrets.Items {
+		secretClient := clientset.CoreV1().Secrets(secret.Namespace)
+		name := secret.Name
+		err := unowned("Secret", secret.ObjectMeta, func(ctx context.Context) error {
+			return secretClient.Delete(ctx, name, metav1.DeleteOptions{})
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// the PVCs are deleted last, they can't be removed while the pods are still using them
+	pvcs, err := clientset.CoreV1().PersistentVolumeClaims(namespace).List(ctx, listOptions)
+	if err != nil {
+		return err
+	}
+	for _, pvc := range pvcs.Items {
+		pvcClient := clientset.CoreV1().PersistentVolumeClaims(pvc.Namespace)
+		name := pvc.Name
+		err := unowned("PersistentVolumeClaim", pvc.ObjectMeta, func(ctx context.Context) error {
+			return pvcClient.Delete(ctx, name, metav1.DeleteOptions{})
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(orphans) == 0 {
+		report(ctx, Event{Action: "gc"}, "✅ No orphaned resources found")
+		setResult(ctx, "deleted", 0)
+		return nil
+	}
+
+	deleted := 0
+	for _, o := range orphans {
+		if dryRun {
+			report(ctx, Event{Resource: o.resource(), Action: "delete", Result: "dry-run"}, "🗑️  Would delete %s (%s)", o.resource(), o.reason)
+			continue
+		}
+
+		err := o.delete(ctx)
+		if err != nil && !k8serrors.IsNotFound(err) {
+			return fmt.Errorf("error deleting %s: %w", o.resource(), err)
+		}
+		report(ctx, Event{Resource: o.resource(), Action: "delete"}, "🗑️  Deleted %s (%s)", o.resource(), o.reason)
+		deleted++
+	}
+
+	if !dryRun {
+		report(ctx, Event{Action: "gc"}, "✅ %d orphaned resources deleted", deleted)
+		setResult(ctx, "deleted", deleted)
+	}
+
+	return nil
+}
+
+func (o orphan) resource() string {
+	return fmt.Sprintf("%s '%s/%s'", o.kind, o.namespace, o.name)
+}
+
+// anyInstrumented returns true if any of the targets, as 'deployment/name' or 'pod/name', still mounts the coverage volume
+func anyInstrumented(ctx context.Context, clientset kubernetes.Interface, namespace string, targets []string) (bool, error) {
+	for _, target := range targets {
+		podSpec, err := targetPodSpec(ctx, clientset, namespace, target)
+		if k8serrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+
+		if isInstrumented(podSpec) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// instrumentedWorkloads returns the deployments and pods of the namespace, as 'deployment/name' or 'pod/name',
+// that mount the coverage volume. The gocoverkube pods, mounting it to collect the coverage, are not included.
+func instrumentedWorkloads(ctx context.Context, clientset kubernetes.Interface, namespace string) ([]string, error) {
+	targets := []string{}
+
+	deployments, err := clientset.AppsV1().Deployments(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for _, deployment := range deployments.Items {
+		if isInstrumented(deployment.Spec.Template.Spec) {
+			targets = append(targets, "deployment/"+deployment.Name)
+		}
+	}
+
+	pods, err := clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: managedByLabel + "!=" + managedByValue,
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, pod := range pods.Items {
+		// the pods of the deployments are instrumented with them
+		if isInstrumented(pod.Spec) && metav1.GetControllerOf(&pod) == nil {
+			targets = append(targets, "pod/"+pod.Name)
+		}
+	}
+
+	return targets, nil
+}
+
+func targetPodSpec(ctx context.Context, clientset kubernetes.Interface, namespace, target string) (v1.PodSpec, error) {
+	kind, name, _ := strings.Cut(target, "/")
+
+	switch kind {
+	case "deployment":
+		deployment, err := clientset.AppsV1().Deployments(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return v1.PodSpec{}, err
+		}
+		return deployment.Spec.Template.Spec, nil
+
+	case "pod":
+		pod, err := clientset.CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return v1.PodSpec{}, err
+		}
+		return pod.Spec, nil
+	}
+
+	return v1.PodSpec{}, fmt.Errorf("invalid session target '%s'", target)
+}
@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// originalImageAnnotation records, on the pod or on the pod template, the image replaced during init
+const originalImageAnnotation = "gocoverkube/original-image"
+
+// ImageOptions replaces the image of the instrumented container with its cover-instrumented variant
+type ImageOptions struct {
+	// Image is the instrumented image
+	Image string
+	// TagSuffix is added to the tag of the original image to get the instrumented one, i.e. '-cover'
+	TagSuffix string
+}
+
+// imageSwap is the image of the instrumented container, and the original one restored by clear.
+// The zero value leaves the image unchanged.
+type imageSwap struct {
+	image    string
+	original string
+}
+
+// newImageSwap returns the image swap of the container. An image already swapped by a previous init is kept,
+// and the instrumented image is always computed from the original one.
+func newImageSwap(annotations map[string]string, container v1.Container, opts ImageOptions) (imageSwap, error) {
+	original, swapped := annotations[originalImageAnnotation]
+	if !swapped {
+		original = container.Image
+	}
+
+	switch {
+	case opts.Image != "":
+		return imageSwap{image: opts.Image, original: original}, nil
+
+	case opts.TagSuffix != "":
+		image, err := withTagSuffix(original, opts.TagSuffix)
+		if err != nil {
+			return imageSwap{}, err
+		}
+		return imageSwap{image: image, original: original}, nil
+
+	case swapped:
+		return imageSwap{image: container.Image, original: original}, nil
+	}
+
+	return imageSwap{}, nil
+}
+
+// withTagSuffix adds the suffix to the tag of the image, 'latest' if it has no tag
+func withTagSuffix(image, suffix string) (string, error) {
+	if strings.Contains(image, "@") {
+		return "", fmt.Errorf("image '%s' is pinned by digest, a tag suffix can't be added, use the instrumented image instead", image)
+	}
+
+	repository, tag := image, "latest"
+	// the tag is after the last '/', a ':' before it is the port of the registry
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		repository, tag = image[:i], image[i+1:]
+	}
+
+	return repository + ":" + tag + suffix, nil
+}
+
+// apply sets the instrumented image in the container, recording the original one in the annotations
+func (s imageSwap) apply(ctx context.Context, annotations map[string]string, container *v1.Container) map[string]string {
+	if s.image == "" {
+		return annotations
+	}
+
+	s.report(ctx, *container)
+	container.Image = s.image
+
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[originalImageAnnotation] = s.original
+	return annotations
+}
+
+// report reports the replacement of the image of the container, if it changes
+func (s imageSwap) report(ctx context.Context, container v1.Container) {
+	if s.image == "" || container.Image == s.image {
+		return
+	}
+	report(ctx, Event{Action: "swap-image"}, "ℹ️  Image of container '%s' replaced with '%s', 'clear' restores '%s'", container.Name, s.image, s.original)
+}
+
+// restoreImage sets the original image in the container, removing it from the annotations
+func restoreImage(ctx context.Context, annotations map[string]string, container *v1.Container) {
+	original, found := annotations[originalImageAnnotation]
+	if !found {
+		return
+	}
+
+	container.Image = original
+	delete(annotations, originalImageAnnotation)
+	report(ctx, Event{Action: "restore-image"}, "ℹ️  Image of container '%s' restored to '%s'", container.Name, original)
+}
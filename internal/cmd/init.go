@@ -18,10 +18,40 @@ const (
 	pvcName    = "gocoverkube-pvc"
 	volumeName = "gocoverkube-tmp-coverage"
 	mountPath  = "/tmp/coverage"
+
+	pvcResource = "PVC '" + pvcName + "'"
 )
 
+// InitOptions configures the instrumentation of a workload
+type InitOptions struct {
+	// Container is the name of the container to instrument, the first one if empty
+	Container string
+	// Image replaces the image of the container, restored by clear
+	Image     ImageOptions
+	Storage   StorageOptions
+	Collector CollectorOptions
+	// ForceConflicts takes over the fields of the deployment owned by other managers, i.e. an existing GOCOVERDIR
+	ForceConflicts bool
+}
+
+// StorageOptions configures the PVC where the coverage is written
+type StorageOptions struct {
+	// Class is the storage class of the PVC, the default one if empty
+	Class string
+	Size  resource.Quantity
+}
+
+func DefaultInitOptions() InitOptions {
+	return InitOptions{
+		Storage: StorageOptions{
+			Size: resource.MustParse("100M"),
+		},
+		Collector: DefaultCollectorOptions(),
+	}
+}
+
 // gocoverkube init
-func InitPod(ctx context.Context, clientset kubernetes.Interface, namespace, podName string) error {
+func InitPod(ctx context.Context, clientset kubernetes.Interface, namespace, podName string, opts InitOptions) error {
 	// check if pod exists
 	podClient := clientset.CoreV1().Pods(namespace)
 	pod, err := podClient.Get(ctx, podName, metav1.GetOptions{})
@@ -29,21 +59,47 @@ func InitPod(ctx context.Context, clientset kubernetes.Interface, namespace, pod
 		return err
 	}
 
-	err = InitStorage(ctx, clientset, namespace)
+	podSpec, err := patchPodSpec(*pod.Spec.DeepCopy(), opts.Container)
 	if err != nil {
-		return err
+		return fmt.Errorf("pod '%s': %w", podName, err)
 	}
 
-	err = createCollectorPod(ctx, clientset, namespace)
+	// the container was found by patchPodSpec
+	i, _ := containerIndex(podSpec, opts.Container)
+	swap, err := newImageSwap(pod.Annotations, podSpec.Containers[i], opts.Image)
 	if err != nil {
-		return err
+		return fmt.Errorf("pod '%s': %w", podName, err)
+	}
+
+	rb := &rollback{}
+
+	err = initCollector(ctx, clientset, namespace, "pod/"+podName, opts, rb)
+	if err != nil {
+		return withRollback(ctx, rb, err)
 	}
 
-	pod.Spec = patchPodSpec(pod.Spec)
-	return deleteAndCreatePod(ctx, clientset, namespace, pod)
+	if !isInstrumented(pod.Spec) {
+		// the pod is deleted, keep a copy of the original manifest to restore it manually if everything else fails
+		backupPath, err := backupPod(pod)
+		if err != nil {
+			return withRollback(ctx, rb, fmt.Errorf("error saving the original pod manifest: %w", err))
+		}
+		report(ctx, Event{Resource: fmt.Sprintf("Pod '%s'", podName), Action: "backup"}, "ℹ️  Original pod manifest saved at '%s'", backupPath)
+		setResult(ctx, "podBackup", backupPath)
+
+		original := pod.DeepCopy()
+		rb.Add(fmt.Sprintf("restore pod '%s'", podName), func(ctx context.Context) error {
+			return restorePod(ctx, clientset, namespace, original)
+		})
+	}
+
+	pod.Spec = podSpec
+	pod.Annotations = swap.apply(ctx, pod.Annotations, &pod.Spec.Containers[i])
+	err = deleteAndCreatePod(ctx, clientset, namespace, pod)
+	return withRollback(ctx, rb, err)
 }
 
-func InitDeployment(ctx context.Context, clientset kubernetes.Interface, namespace, deploymentName string) error {
+func InitDeployment(ctx context.Context, clientset kubernetes.Interface, namespace, deploymentName string, opts InitOptions) error {
 	// check if deployment exists
 	deploymentClient := clientset.AppsV1().Deployments(namespace)
 	deployment, err := deploymentClient.Get(ctx, deploymentName, metav1.GetOptions{})
@@ -51,36 +107,103 @@ func InitDeployment(ctx context.Context, clientset kubernetes.Interface, namespa
 		return err
 	}
 
-	err = InitStorage(ctx, clientset, namespace)
+	i, err := containerIndex(deployment.Spec.Template.Spec, opts.Container)
 	if err != nil {
-		return err
+		return fmt.Errorf("deployment '%s': %w", deploymentName, err)
 	}
+	container := deployment.Spec.Template.Spec.Containers[i]
 
-	err = createCollectorPod(ctx, clientset, namespace)
+	swap, err := newImageSwap(deployment.Spec.Template.Annotations, container, opts.Image)
 	if err != nil {
-		return err
+		return fmt.Errorf("deployment '%s': %w", deploymentName, err)
+	}
+
+	rb := &rollback{}
+
+	err = initCollector(ctx, clientset, namespace, "deployment/"+deploymentName, opts, rb)
+	if err != nil {
+		return withRollback(ctx, rb, err)
 	}
 
-	deployment.Spec.Template.Spec = patchPodSpec(deployment.Spec.Template.Spec)
-	return updateAndRestartDeployment(ctx, clientset, namespace, deployment)
+	if !isInstrumented(deployment.Spec.Template.Spec) {
+		rb.Add(fmt.Sprintf("restore deployment '%s'", deploymentName), func(ctx context.Context) error {
+			return clearDeploymentSpec(ctx, clientset, namespace, deploymentName)
+		})
+	}
+
+	swap.report(ctx, container)
+	err = instrumentDeployment(ctx, clientset, namespace, deployment, container.Name, swap, opts.ForceConflicts)
+	return withRollback(ctx, rb, err)
 }
 
-func InitStorage(ctx context.Context, clientset kubernetes.Interface, namespace string) error {
-	storageClass, err := getDefaultStorageClass(ctx, clientset)
+// initCollector creates the session of the target and the PVC, the collector Secret and the collector pod
+// owned by it, recording them in the rollback
+func initCollector(ctx context.Context, clientset kubernetes.Interface, namespace, target string, opts InitOptions, rb *rollback) error {
+	session, created, err := createSession(ctx, clientset, namespace, target)
+	if created {
+		rb.Add("delete session", func(ctx context.Context) error {
+			return deleteSession(ctx, clientset, namespace)
+		})
+	}
+	if err != nil {
+		return err
+	}
+	owners := ownerReferences(session)
+
+	created, err = InitStorage(ctx, clientset, namespace, opts.Storage, owners)
+	if created {
+		rb.Add("delete PVC", func(ctx context.Context) error {
+			return deletePVC(ctx, clientset, namespace)
+		})
+	}
 	if err != nil {
 		return err
 	}
 
+	created, err = createCollectorSecret(ctx, clientset, namespace, owners)
+	if created {
+		rb.Add("delete collector Secret", func(ctx context.Context) error {
+			return deleteCollectorSecret(ctx, clientset, namespace)
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	created, err = createCollectorPod(ctx, clientset, namespace, opts.Collector, owners)
+	if created {
+		rb.Add("delete collector Pod", func(ctx context.Context) error {
+			return deleteCollectorPod(ctx, clientset, namespace)
+		})
+	}
+	return err
+}
+
+// InitStorage creates the PVC where the coverage is written, owned by the owners. It returns true if the PVC was created.
+func InitStorage(ctx context.Context, clientset kubernetes.Interface, namespace string, storage StorageOptions, owners []metav1.OwnerReference) (bool, error) {
+	storageClass := storage.Class
+	if storageClass == "" {
+		var err error
+		storageClass, err = getDefaultStorageClass(ctx, clientset)
+		if err != nil {
+			return false, err
+		}
+	}
+
 	pvcClient := clientset.CoreV1().PersistentVolumeClaims(namespace)
-	err = claimPersistentVolume(ctx, pvcClient, storageClass)
+	err := claimPersistentVolume(ctx, pvcClient, storageClass, storage.Size, owners)
 	if err != nil {
 		if !k8serrors.IsAlreadyExists(err) {
-			return err
+			return false, err
 		}
+		// the PVC is shared by the targets of the namespace
+		report(ctx, Event{Resource: pvcResource, Action: "create", Result: "skipped"}, "ℹ️  PVC already exists, reusing it")
+		return false, nil
 	}
-	fmt.Println("✅ PVC created")
+	trackResource(ctx, pvcResource, "created")
+	report(ctx, Event{Resource: pvcResource, Action: "create"}, "✅ PVC created")
 
-	return nil
+	return true, nil
 }
 
 // getDefaultStorageClass will get the default storage class
@@ -103,13 +226,18 @@ func getDefaultStorageClass(ctx context.Context, clientset kubernetes.Interface)
 }
 
 // claimPersistentVolume
-func claimPersistentVolume(ctx context.Context, pvcClient typedcorev1.PersistentVolumeClaimInterface, storageClass string) error {
+func claimPersistentVolume(
+	ctx context.Context,
+	pvcClient typedcorev1.PersistentVolumeClaimInterface,
+	storageClass string,
+	size resource.Quantity,
+	owners []metav1.OwnerReference,
+) error {
 	pvc := &v1.PersistentVolumeClaim{
 		ObjectMeta: metav1.ObjectMeta{
-			Name: pvcName,
-			Labels: map[string]string{
-				"app.kubernetes.io/managed-by": "gocoverkube",
-			},
+			Name:            pvcName,
+			Labels:          managedLabels("storage"),
+			OwnerReferences: owners,
 		},
 		Spec: v1.PersistentVolumeClaimSpec{
 			AccessModes: []v1.PersistentVolumeAccessMode{
@@ -118,7 +246,7 @@ func claimPersistentVolume(ctx context.Context, pvcClient typedcorev1.Persistent
 			StorageClassName: &storageClass,
 			Resources: v1.ResourceRequirements{
 				Requests: v1.ResourceList{
-					v1.ResourceStorage: resource.MustParse("100M"),
+					v1.ResourceStorage: size,
 				},
 			},
 		},
@@ -135,21 +263,65 @@ func claimPersistentVolume(ctx context.Context, pvcClient typedcorev1.Persistent
 	return err
 }
 
-func patchPodSpec(podSpec v1.PodSpec) v1.PodSpec {
+// isInstrumented returns true if the pod spec already mounts the coverage volume
+func isInstrumented(podSpec v1.PodSpec) bool {
+	for _, v := range podSpec.Volumes {
+		if v.Name == volumeName {
+			return true
+		}
+	}
+	return false
+}
+
+// instrumentedContainer returns the name of the container that mounts the coverage volume, if any
+func instrumentedContainer(podSpec v1.PodSpec) (string, bool) {
+	for _, c := range podSpec.Containers {
+		for _, vm := range c.VolumeMounts {
+			if vm.Name == volumeName {
+				return c.Name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// containerIndex returns the index of the named container, or of the first one if the name is empty
+func containerIndex(podSpec v1.PodSpec, name string) (int, error) {
+	if len(podSpec.Containers) == 0 {
+		return 0, errors.New("no containers found")
+	}
+	if name == "" {
+		return 0, nil
+	}
+
+	for i, c := range podSpec.Containers {
+		if c.Name == name {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("container '%s' not found", name)
+}
+
+func patchPodSpec(podSpec v1.PodSpec, containerName string) (v1.PodSpec, error) {
+	i, err := containerIndex(podSpec, containerName)
+	if err != nil {
+		return podSpec, err
+	}
+
 	// FIX for PVC hanging during pod recreation
 	podSpec.NodeName = ""
 
-	container := podSpec.Containers[0]
+	container := podSpec.Containers[i]
 	// add GOCOVERDIR env var
 	container.Env = setEnvVar(container.Env)
 	// mount /tmp/coverage volume
 	container.VolumeMounts = setVolumeMount(container.VolumeMounts)
-	podSpec.Containers[0] = container
+	podSpec.Containers[i] = container
 
 	// bind /tmp/coverage volume to PVC
 	podSpec.Volumes = setVolume(podSpec.Volumes)
 
-	return podSpec
+	return podSpec, nil
 }
 
 func setEnvVar(env []v1.EnvVar) []v1.EnvVar {
@@ -0,0 +1,363 @@
+package cmd
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	lockName          = "gocoverkube-lock"
+	lockDuration      = 60 * time.Second
+	lockRenewInterval = 20 * time.Second
+	// lockRenewDeadline is the time after the last renewal when the lock is given up, before it expires for the others
+	lockRenewDeadline   = lockDuration - lockRenewInterval
+	lockRenewRetryDelay = 2 * time.Second
+
+	lockResource = "Lease '" + lockName + "'"
+)
+
+// Lock is a namespace lock held by a gocoverkube invocation, backed by a coordination.k8s.io Lease
+type Lock struct {
+	clientset kubernetes.Interface
+	namespace string
+	identity  string
+
+	// observedVersion is the version of the lease held by someone else, first seen at observedTime with the local clock.
+	// The lease expires a duration after it is observed, so that the clocks of the holders don't need to be in sync.
+	observedVersion string
+	observedTime    time.Time
+
+	// ctx is cancelled when the lock is lost
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+
+	stopRenew chan struct{}
+	renewDone chan struct{}
+}
+
+// AcquireLock acquires the lock of the namespace, renewing it in background until released.
+// If the lock is held by another invocation it waits up to waitForLock for it to be released or to expire.
+// The context of the lock is cancelled if it is lost, or can't be renewed.
+func AcquireLock(ctx context.Context, clientset kubernetes.Interface, namespace string, waitForLock time.Duration) (*Lock, error) {
+	lock := &Lock{
+		clientset: clientset,
+		namespace: namespace,
+		identity:  lockIdentity(),
+		stopRenew: make(chan struct{}),
+		renewDone: make(chan struct{}),
+	}
+
+	deadline := time.Now().Add(waitForLock)
+
+	for {
+		lease, err := lock.tryAcquire(ctx)
+		if err == nil {
+			break
+		}
+
+		var held *errLockHeld
+		if !errors.As(err, &held) {
+			return nil, err
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, fmt.Errorf("%w, use '--wait-for-lock' to wait for it or 'gocoverkube force-unlock' to release it", err)
+		}
+
+		// a zero timeout would wait forever for a lease that won't change, it's acquired right away if already expired
+		wait := min(remaining, time.Until(held.expiry))
+		if wait <= 0 {
+			continue
+		}
+
+		report(ctx, Event{Resource: lockResource, Action: "lock", Result: "waiting"}, "⏳ %s, waiting", err)
+
+		// wait for the lease to change, or to expire
+		waitCtx := WithWaitTimeout(ctx, wait)
+		err = waitForLease(waitCtx, clientset, namespace, func(l *coordinationv1.Lease) bool {
+			return l == nil || l.ResourceVersion != lease.ResourceVersion
+		})
+
+		var timeoutErr *errWaitTimeout
+		if err != nil && !errors.As(err, &timeoutErr) {
+			return nil, err
+		}
+	}
+
+	report(ctx, Event{Resource: lockResource, Action: "lock"}, "🔒 Lock acquired on namespace '%s'", namespace)
+
+	lock.ctx, lock.cancel = context.WithCancelCause(ctx)
+	go lock.renew(ctx)
+
+	return lock, nil
+}
+
+// Context returns the context of the lock, cancelled with the cause if the lock is lost
+func (l *Lock) Context() context.Context {
+	return l.ctx
+}
+
+// Release stops renewing the lock and deletes it, if still held
+func (l *Lock) Release(ctx context.Context) error {
+	close(l.stopRenew)
+	<-l.renewDone
+	l.cancel(nil)
+
+	ctx = context.WithoutCancel(ctx)
+
+	leaseClient := l.clientset.CoordinationV1().Leases(l.namespace)
+	lease, err := leaseClient.Get(ctx, lockName, metav1.GetOptions{})
+	if err != nil {
+		if k8serrors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+
+	// the lock was forcibly released and acquired by someone else
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != l.identity {
+		return nil
+	}
+
+	err = leaseClient.Delete(ctx, lockName, metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{ResourceVersion: &lease.ResourceVersion},
+	})
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return err
+	}
+
+	return nil
+}
+
+// ForceUnlock deletes the lock of the namespace, whoever holds it
+func ForceUnlock(ctx context.Context, clientset kubernetes.Interface, namespace string) error {
+	leaseClient := clientset.CoordinationV1().Leases(namespace)
+	lease, err := leaseClient.Get(ctx, lockName, metav1.GetOptions{})
+	if err != nil {
+		if k8serrors.IsNotFound(err) {
+			report(ctx, Event{Resource: lockResource, Action: "unlock", Result: "skipped"}, "ℹ️  Namespace '%s' is not locked", namespace)
+			return nil
+		}
+		return err
+	}
+
+	err = leaseClient.Delete(ctx, lockName, metav1.DeleteOptions{})
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return err
+	}
+
+	report(ctx, Event{Resource: lockResource, Action: "unlock"}, "🔓 Lock on namespace '%s' held by '%s' released", namespace, holder(lease))
+	return nil
+}
+
+// errLockHeld is returned when the lock is held by another invocation
+type errLockHeld struct {
+	namespace string
+	holder    string
+	expiry    time.Time
+}
+
+func (e *errLockHeld) Error() string {
+	return fmt.Sprintf(
+		"namespace '%s' is locked by '%s' (expires in %v)",
+		e.namespace, e.holder, time.Until(e.expiry).Round(time.Second),
+	)
+}
+
+// tryAcquire creates the lease, or takes it over if expired. It returns the current lease if held by someone else.
+func (l *Lock) tryAcquire(ctx context.Context) (*coordinationv1.Lease, error) {
+	leaseClient := l.clientset.CoordinationV1().Leases(l.namespace)
+	now := metav1.NewMicroTime(time.Now())
+	durationSeconds := int32(lockDuration.Seconds())
+
+	lease, err := leaseClient.Get(ctx, lockName, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		lease, err = leaseClient.Create(ctx, &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   lockName,
+				Labels: managedLabels("lock"),
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &l.identity,
+				LeaseDurationSeconds: &durationSeconds,
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}, metav1.CreateOptions{})
+
+		// someone else created it in the meantime
+		if k8serrors.IsAlreadyExists(err) {
+			return l.tryAcquire(ctx)
+		}
+		return lease, err
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// every renewal changes the version, observed again with the local clock
+	if lease.ResourceVersion != l.observedVersion {
+		l.observedVersion = lease.ResourceVersion
+		l.observedTime = time.Now()
+	}
+	if expiry := l.observedTime.Add(leaseDuration(lease)); time.Now().Before(expiry) {
+		return lease, &errLockHeld{namespace: l.namespace, holder: holder(lease), expiry: expiry}
+	}
+
+	// the lease expired, take it over. The update fails on conflict if someone else did it first.
+	lease.Spec.HolderIdentity = &l.identity
+	lease.Spec.LeaseDurationSeconds = &durationSeconds
+	lease.Spec.AcquireTime = &now
+	lease.Spec.RenewTime = &now
+
+	lease, err = leaseClient.Update(ctx, lease, metav1.UpdateOptions{})
+	if k8serrors.IsConflict(err) {
+		return l.tryAcquire(ctx)
+	}
+	return lease, err
+}
+
+// renew renews the lease until released. If it can't be renewed before the deadline, or it is held by someone else,
+// the context of the lock is cancelled: the lock may be taken over. The context is only used for the output.
+func (l *Lock) renew(ctx context.Context) {
+	defer close(l.renewDone)
+
+	timer := time.NewTimer(lockRenewInterval)
+	defer timer.Stop()
+
+	lastRenew := time.Now()
+
+	for {
+		select {
+		case <-l.stopRenew:
+			return
+		case <-timer.C:
+		}
+
+		err := l.renewOnce(ctx)
+
+		var lost *errLockLost
+		switch {
+		case errors.As(err, &lost):
+			warn(ctx, "⚠️  %s", err)
+			l.cancel(err)
+			return
+		case err == nil:
+			lastRenew = time.Now()
+			timer.Reset(lockRenewInterval)
+		case time.Since(lastRenew) >= lockRenewDeadline:
+			err = fmt.Errorf("unable to renew the lock on namespace '%s' for %v, it may be taken over: %w", l.namespace, time.Since(lastRenew).Round(time.Second), err)
+			warn(ctx, "⚠️  %s", err)
+			l.cancel(err)
+			return
+		default:
+			warn(ctx, "⚠️  Error renewing the lock on namespace '%s', retrying: %s", l.namespace, err)
+			timer.Reset(lockRenewRetryDelay)
+		}
+	}
+}
+
+// errLockLost is returned when the lock is held by someone else while renewing it
+type errLockLost struct {
+	namespace string
+	holder    string
+}
+
+func (e *errLockLost) Error() string {
+	return fmt.Sprintf("lock on namespace '%s' lost, now held by '%s'", e.namespace, e.holder)
+}
+
+// renewOnce renews the lease, also after the context is cancelled: the lock is held until released
+func (l *Lock) renewOnce(ctx context.Context) error {
+	leaseClient := l.clientset.CoordinationV1().Leases(l.namespace)
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), lockRenewRetryDelay*5)
+	defer cancel()
+
+	lease, err := leaseClient.Get(ctx, lockName, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		return &errLockLost{namespace: l.namespace, holder: "nobody"}
+	}
+	if err != nil {
+		return err
+	}
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != l.identity {
+		return &errLockLost{namespace: l.namespace, holder: holder(lease)}
+	}
+
+	now := metav1.NewMicroTime(time.Now())
+	lease.Spec.RenewTime = &now
+	_, err = leaseClient.Update(ctx, lease, metav1.UpdateOptions{})
+	return err
+}
+
+func waitForLease(ctx context.Context, clientset kubernetes.Interface, namespace string, condition func(*coordinationv1.Lease) bool) error {
+	leaseClient := clientset.CoordinationV1().Leases(namespace)
+	fieldSelector := fields.OneTermEqualSelector("metadata.name", lockName).String()
+
+	lw := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.FieldSelector = fieldSelector
+			return leaseClient.List(ctx, options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.FieldSelector = fieldSelector
+			return leaseClient.Watch(ctx, options)
+		},
+	}
+
+	return waitFor(ctx, lw, &coordinationv1.Lease{}, func(objs []runtime.Object) (bool, error) {
+		if len(objs) == 0 {
+			return condition(nil), nil
+		}
+		return condition(objs[0].(*coordinationv1.Lease)), nil
+	})
+}
+
+func leaseDuration(lease *coordinationv1.Lease) time.Duration {
+	if lease.Spec.LeaseDurationSeconds == nil {
+		return 0
+	}
+	return time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second
+}
+
+func holder(lease *coordinationv1.Lease) string {
+	if lease.Spec.HolderIdentity == nil {
+		return "unknown"
+	}
+	return *lease.Spec.HolderIdentity
+}
+
+// lockIdentity identifies this invocation, as 'user@host/pid-random'
+func lockIdentity() string {
+	username := "unknown"
+	if u, err := user.Current(); err == nil {
+		username = u.Username
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+
+	suffix := make([]byte, 4)
+	_, _ = rand.Read(suffix)
+
+	return fmt.Sprintf("%s@%s/%d-%s", username, hostname, os.Getpid(), hex.EncodeToString(suffix))
+}
@@ -0,0 +1,192 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// LevelTrace logs every request to the Kubernetes API
+const LevelTrace = slog.LevelDebug - 4
+
+// DebugLogFile is the name of the debug log written next to the collected coverage
+const DebugLogFile = "gocoverkube-debug.log"
+
+type loggerKey struct{}
+
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// NewLogger returns a text logger with the level of the verbosity: 1 logs the state transitions of the pods,
+// 2 the iterations of the wait loops, 3 every request to the Kubernetes API
+func NewLogger(w io.Writer, verbosity int) *slog.Logger {
+	if verbosity <= 0 {
+		return discardLogger
+	}
+
+	level := slog.LevelInfo
+	switch {
+	case verbosity == 2:
+		level = slog.LevelDebug
+	case verbosity >= 3:
+		level = LevelTrace
+	}
+
+	return slog.New(slog.NewTextHandler(w, &slog.HandlerOptions{Level: level, ReplaceAttr: replaceLevel}))
+}
+
+// WithLogger returns a context where the internal/cmd functions, and the Kubernetes requests, log with the logger
+func WithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// WithDebugLog returns a context that logs also to the writer, at the trace level
+func WithDebugLog(ctx context.Context, w io.Writer) context.Context {
+	fileHandler := slog.NewTextHandler(w, &slog.HandlerOptions{Level: LevelTrace, ReplaceAttr: replaceLevel})
+	return WithLogger(ctx, slog.New(&multiHandler{
+		handlers: []slog.Handler{logger(ctx).Handler(), fileHandler},
+	}))
+}
+
+func logger(ctx context.Context) *slog.Logger {
+	l, ok := ctx.Value(loggerKey{}).(*slog.Logger)
+	if !ok {
+		return discardLogger
+	}
+	return l
+}
+
+// LogRequests wraps a Kubernetes client transport, logging every request with the logger of its context
+func LogRequests(rt http.RoundTripper) http.RoundTripper {
+	return &loggingRoundTripper{rt: rt}
+}
+
+type loggingRoundTripper struct {
+	rt http.RoundTripper
+}
+
+func (t *loggingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	log := logger(req.Context())
+	start := time.Now()
+
+	resp, err := t.rt.RoundTrip(req)
+	if err != nil {
+		log.Log(req.Context(), LevelTrace, "kubernetes request",
+			"method", req.Method, "url", req.URL.String(), "duration", time.Since(start), "error", err)
+		return resp, err
+	}
+
+	log.Log(req.Context(), LevelTrace, "kubernetes request",
+		"method", req.Method, "url", req.URL.String(), "status", resp.StatusCode, "duration", time.Since(start))
+	return resp, nil
+}
+
+// podStateLogger logs the state transitions of the pods seen by a wait
+type podStateLogger struct {
+	states map[string]string
+}
+
+func (l *podStateLogger) Log(ctx context.Context, pods []*v1.Pod) {
+	if l.states == nil {
+		l.states = map[string]string{}
+	}
+
+	seen := map[string]bool{}
+	for _, pod := range pods {
+		seen[pod.Name] = true
+
+		state := podState(pod)
+		if previous, found := l.states[pod.Name]; !found || previous != state {
+			logger(ctx).Info("pod state", "pod", pod.Name, "from", previous, "to", state)
+			l.states[pod.Name] = state
+		}
+	}
+
+	for name, previous := range l.states {
+		if !seen[name] {
+			logger(ctx).Info("pod state", "pod", name, "from", previous, "to", "Deleted")
+			delete(l.states, name)
+		}
+	}
+}
+
+// podState describes the phase of the pod and the state of its containers
+func podState(pod *v1.Pod) string {
+	var sb strings.Builder
+	sb.WriteString(string(pod.Status.Phase))
+	if pod.DeletionTimestamp != nil {
+		sb.WriteString(" (terminating)")
+	}
+
+	for _, cs := range pod.Status.ContainerStatuses {
+		state := "unknown"
+		switch {
+		case cs.State.Waiting != nil:
+			state = "waiting: " + cs.State.Waiting.Reason
+		case cs.State.Running != nil && cs.Ready:
+			state = "ready"
+		case cs.State.Running != nil:
+			state = "running"
+		case cs.State.Terminated != nil:
+			state = "terminated: " + cs.State.Terminated.Reason
+		}
+		fmt.Fprintf(&sb, ", %s %s", cs.Name, state)
+	}
+
+	return sb.String()
+}
+
+// replaceLevel names the trace level
+func replaceLevel(_ []string, a slog.Attr) slog.Attr {
+	if a.Key == slog.LevelKey && a.Value.Any() == LevelTrace {
+		return slog.String(slog.LevelKey, "TRACE")
+	}
+	return a
+}
+
+// multiHandler sends the records to all the handlers
+type multiHandler struct {
+	handlers []slog.Handler
+}
+
+func (h *multiHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, handler := range h.handlers {
+		if handler.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *multiHandler) Handle(ctx context.Context, r slog.Record) error {
+	for _, handler := range h.handlers {
+		if !handler.Enabled(ctx, r.Level) {
+			continue
+		}
+		if err := handler.Handle(ctx, r.Clone()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *multiHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handlers := []slog.Handler{}
+	for _, handler := range h.handlers {
+		handlers = append(handlers, handler.WithAttrs(attrs))
+	}
+	return &multiHandler{handlers: handlers}
+}
+
+func (h *multiHandler) WithGroup(name string) slog.Handler {
+	handlers := []slog.Handler{}
+	for _, handler := range h.handlers {
+		handlers = append(handlers, handler.WithGroup(name))
+	}
+	return &multiHandler{handlers: handlers}
+}
@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const manifestName = ".gocoverkube-manifest.json"
+
+// manifest keeps track of the coverage files already downloaded in the output directory.
+// Coverage files are write-once and uniquely named, so a file in the manifest never needs to be copied again.
+type manifest struct {
+	path  string
+	Files map[string]manifestEntry `json:"files"`
+}
+
+type manifestEntry struct {
+	Size        int64     `json:"size"`
+	SHA256      string    `json:"sha256"`
+	CollectedAt time.Time `json:"collectedAt"`
+}
+
+func loadManifest(dir string) (*manifest, error) {
+	m := &manifest{
+		path:  filepath.Join(dir, manifestName),
+		Files: map[string]manifestEntry{},
+	}
+
+	data, err := os.ReadFile(m.path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return m, nil
+		}
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, m)
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func (m *manifest) Contains(f remoteFile) bool {
+	entry, found := m.Files[f.path]
+	return found && entry.SHA256 == f.checksum
+}
+
+func (m *manifest) Add(f remoteFile) {
+	m.Files[f.path] = manifestEntry{
+		Size:        f.size,
+		SHA256:      f.checksum,
+		CollectedAt: time.Now(),
+	}
+}
+
+// Save writes the manifest atomically, to keep it consistent if the collection is interrupted
+func (m *manifest) Save() error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := m.path + ".tmp"
+	err = os.WriteFile(tmp, data, 0o644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, m.path)
+}
+
+// isCoverageFile returns true for the meta-data and counter files written by the Go runtime
+func isCoverageFile(name string) bool {
+	base := filepath.Base(name)
+	return strings.HasPrefix(base, covMetaPrefix) || strings.HasPrefix(base, covCountersPrefix)
+}
@@ -0,0 +1,195 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/briandowns/spinner"
+	"golang.org/x/term"
+)
+
+const (
+	OutputText = "text"
+	OutputJSON = "json"
+)
+
+// Printer writes the progress of a command, as text lines or as one JSON event per line
+type Printer struct {
+	mu       sync.Mutex
+	w        io.Writer
+	format   string
+	quiet    bool
+	spinners bool
+	start    time.Time
+	results  map[string]any
+}
+
+// Event is a step of a command, as written in the JSON output
+type Event struct {
+	Time     time.Time `json:"time"`
+	Resource string    `json:"resource,omitempty"`
+	Action   string    `json:"action"`
+	// Duration is written in seconds
+	Duration time.Duration `json:"-"`
+	Result   string        `json:"result"`
+	Message  string        `json:"message"`
+}
+
+type printerKey struct{}
+
+// NewPrinter returns a Printer writing to stdout in the format, 'text' or 'json'.
+// If quiet only the errors and the final JSON document are written.
+func NewPrinter(format string, quiet bool) (*Printer, error) {
+	if format != OutputText && format != OutputJSON {
+		return nil, fmt.Errorf("invalid output format '%s', must be one of '%s' or '%s'", format, OutputText, OutputJSON)
+	}
+
+	return &Printer{
+		w:      os.Stdout,
+		format: format,
+		quiet:  quiet,
+		// the spinners are unreadable in the logs
+		spinners: format == OutputText && !quiet && term.IsTerminal(int(os.Stdout.Fd())),
+		start:    time.Now(),
+		results:  map[string]any{},
+	}, nil
+}
+
+// WithPrinter returns a context where the internal/cmd functions write their progress with the Printer
+func WithPrinter(ctx context.Context, p *Printer) context.Context {
+	return context.WithValue(ctx, printerKey{}, p)
+}
+
+var defaultPrinter, _ = NewPrinter(OutputText, false)
+
+func printer(ctx context.Context) *Printer {
+	p, ok := ctx.Value(printerKey{}).(*Printer)
+	if !ok {
+		return defaultPrinter
+	}
+	return p
+}
+
+// report writes a step of the command: the text line, or the event with the text as message
+func report(ctx context.Context, event Event, format string, args ...any) {
+	text := fmt.Sprintf(format, args...)
+	logger(ctx).Debug("step", "resource", event.Resource, "action", event.Action, "result", event.Result, "message", text)
+	printer(ctx).print(event, text)
+}
+
+// warn writes a warning to stderr, or as an event
+func warn(ctx context.Context, format string, args ...any) {
+	p := printer(ctx)
+	text := fmt.Sprintf(format, args...)
+
+	if p.format == OutputJSON {
+		p.print(Event{Action: "warning", Result: "warning"}, text)
+		return
+	}
+	fmt.Fprintln(os.Stderr, text)
+}
+
+// Warn writes a warning with the printer of the context, for the commands outside of this package
+func Warn(ctx context.Context, format string, args ...any) {
+	warn(ctx, format, args...)
+}
+
+// HasPrinter returns true if the context has a Printer, that is missing if the command failed before setting it up
+func HasPrinter(ctx context.Context) bool {
+	_, ok := ctx.Value(printerKey{}).(*Printer)
+	return ok
+}
+
+// setResult adds a value to the final JSON document of the command
+func setResult(ctx context.Context, key string, value any) {
+	p := printer(ctx)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.results[key] = value
+}
+
+// newSpinner returns a spinner, disabled if the output is not a terminal
+func newSpinner(ctx context.Context) *spinner.Spinner {
+	s := spinner.New(spinner.CharSets[9], 100*time.Millisecond)
+	if !printer(ctx).spinners {
+		s.Disable()
+	}
+	return s
+}
+
+// Finish writes the final JSON document of the command, with its result
+func Finish(ctx context.Context, command string, err error) {
+	p := printer(ctx)
+	if p.format != OutputJSON {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	doc := map[string]any{
+		"command":         command,
+		"result":          "success",
+		"durationSeconds": time.Since(p.start).Seconds(),
+	}
+	if err != nil {
+		doc["result"] = "error"
+		doc["error"] = err.Error()
+	}
+	if len(p.results) > 0 {
+		doc["details"] = p.results
+	}
+
+	p.writeJSON(doc)
+}
+
+func (p *Printer) print(event Event, text string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.quiet {
+		return
+	}
+
+	if p.format == OutputText {
+		fmt.Fprintln(p.w, text)
+		return
+	}
+
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	if event.Result == "" {
+		event.Result = "success"
+	}
+	// the message is the text line without the leading emoji
+	event.Message = text
+	if r, _ := utf8.DecodeRuneInString(text); r > unicode.MaxASCII {
+		if _, message, found := strings.Cut(text, " "); found {
+			event.Message = strings.TrimLeft(message, " ")
+		}
+	}
+
+	type jsonEvent struct {
+		Event
+		DurationSeconds float64 `json:"durationSeconds,omitempty"`
+	}
+	p.writeJSON(jsonEvent{Event: event, DurationSeconds: event.Duration.Seconds()})
+}
+
+func (p *Printer) writeJSON(v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error encoding output: %s\n", err)
+		return
+	}
+	fmt.Fprintln(p.w, string(data))
+}
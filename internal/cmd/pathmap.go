@@ -0,0 +1,315 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// maxUnresolvedFiles is the number of unresolved files listed in the warning
+const maxUnresolvedFiles = 10
+
+// PathMapOptions maps the import paths recorded in the coverage data to the local source files,
+// needed by the reports when the sources are not in GOPATH or in the module of the working directory
+type PathMapOptions struct {
+	// Mappings are 'importpath=dir' pairs, taking priority over the detected ones
+	Mappings []string
+	// Detect maps the modules of the go.mod or go.work of the working directory, with their vendored and locally replaced modules
+	Detect bool
+}
+
+func DefaultPathMapOptions() PathMapOptions {
+	return PathMapOptions{Detect: true}
+}
+
+type pathMapping struct {
+	importPath string
+	dir        string
+}
+
+// pathMapper rewrites the files of the profiles, keeping track of the ones not found locally
+type pathMapper struct {
+	mappings   []pathMapping
+	unresolved map[string]bool
+}
+
+// newPathMapper returns the mapper of the options, with the longest import paths first
+func newPathMapper(ctx context.Context, opts PathMapOptions) (*pathMapper, error) {
+	m := &pathMapper{unresolved: map[string]bool{}}
+
+	for _, mapping := range opts.Mappings {
+		importPath, dir, found := strings.Cut(mapping, "=")
+		if !found || importPath == "" || dir == "" {
+			return nil, fmt.Errorf("invalid path mapping '%s', must be 'importpath=dir'", mapping)
+		}
+		m.add(strings.TrimSuffix(importPath, "/"), dir)
+	}
+
+	if opts.Detect {
+		detected, err := detectModules(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, mapping := range detected {
+			m.add(mapping.importPath, mapping.dir)
+		}
+	}
+
+	sort.SliceStable(m.mappings, func(i, j int) bool {
+		return len(m.mappings[i].importPath) > len(m.mappings[j].importPath)
+	})
+	return m, nil
+}
+
+// add adds the mapping, unless the import path is already mapped
+func (m *pathMapper) add(importPath, dir string) {
+	for _, mapping := range m.mappings {
+		if mapping.importPath == importPath {
+			return
+		}
+	}
+	m.mappings = append(m.mappings, pathMapping{importPath: importPath, dir: dir})
+}
+
+// resolve returns the local path of the file of the profile, or the file itself if it can't be found
+func (m *pathMapper) resolve(file string) string {
+	if len(m.mappings) == 0 {
+		return file
+	}
+
+	for _, mapping := range m.mappings {
+		rest, found := strings.CutPrefix(file, mapping.importPath)
+		if !found || (rest != "" && !strings.HasPrefix(rest, "/")) {
+			continue
+		}
+
+		// a shorter import path can be mapped to another directory having the file
+		path := filepath.Join(mapping.dir, filepath.FromSlash(rest))
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		return localPath(path)
+	}
+
+	m.unresolved[file] = true
+	return file
+}
+
+// localPath returns the path relative to the working directory, starting with '.' so that it's not taken for an import path
+func localPath(path string) string {
+	if filepath.IsAbs(path) {
+		wd, err := os.Getwd()
+		if err != nil {
+			return path
+		}
+		rel, err := filepath.Rel(wd, path)
+		if err != nil {
+			return path
+		}
+		path = rel
+	}
+
+	path = filepath.ToSlash(path)
+	if !strings.HasPrefix(path, "../") {
+		path = "./" + path
+	}
+	return path
+}
+
+// rewriteProfile replaces the files of the text profile with their local paths
+func (m *pathMapper) rewriteProfile(profile string) error {
+	if len(m.mappings) == 0 {
+		return nil
+	}
+
+	in, err := os.Open(profile)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmpProfile := profile + ".tmp"
+	out, err := os.Create(tmpProfile)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpProfile)
+
+	err = m.rewriteLines(in, out)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpProfile, profile)
+}
+
+func (m *pathMapper) rewriteLines(r io.Reader, w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		// name.go:line.column,line.column numberOfStatements count
+		if !strings.HasPrefix(line, "mode:") {
+			if i := strings.LastIndex(line, ":"); i > 0 {
+				line = m.resolve(line[:i]) + line[i:]
+			}
+		}
+
+		if _, err := fmt.Fprintln(bw, line); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// warnUnresolved warns about the files of the profiles that were not found locally
+func (m *pathMapper) warnUnresolved(ctx context.Context) {
+	if len(m.unresolved) == 0 {
+		return
+	}
+
+	files := []string{}
+	for file := range m.unresolved {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	setResult(ctx, "unresolvedFiles", files)
+
+	listed := files
+	if len(listed) > maxUnresolvedFiles {
+		listed = listed[:maxUnresolvedFiles]
+	}
+	message := fmt.Sprintf("⚠️  Source files of the profile not found locally (%d), map their import path to the source directory with '--map importpath=dir':", len(files))
+	for _, file := range listed {
+		message += "\n   " + file
+	}
+	if len(files) > len(listed) {
+		message += fmt.Sprintf("\n   and %d more", len(files)-len(listed))
+	}
+	warn(ctx, "%s", message)
+}
+
+// detectModules returns the main modules of the working directory, with the workspace ones if in a go.work,
+// and their vendored and locally replaced modules. Nothing is returned outside of a module.
+func detectModules(ctx context.Context) ([]pathMapping, error) {
+	if checkGoToolchain() != nil {
+		return nil, nil
+	}
+
+	gomod, err := goTool(ctx, nil, "env", "GOMOD")
+	if err != nil {
+		return nil, err
+	}
+	// outside of a module GOMOD is empty, or os.DevNull in module mode
+	if gomod == "" || gomod == os.DevNull {
+		gowork, err := goTool(ctx, nil, "env", "GOWORK")
+		if err != nil || gowork == "" || gowork == "off" {
+			return nil, err
+		}
+	}
+
+	out, err := goTool(ctx, nil, "list", "-m", "-json")
+	if err != nil {
+		return nil, err
+	}
+
+	type module struct {
+		Path  string
+		Dir   string
+		GoMod string
+	}
+
+	mappings := []pathMapping{}
+	decoder := json.NewDecoder(strings.NewReader(out))
+	for decoder.More() {
+		var mod module
+		if err := decoder.Decode(&mod); err != nil {
+			return nil, err
+		}
+		if mod.Dir == "" {
+			continue
+		}
+		mappings = append(mappings, pathMapping{importPath: mod.Path, dir: mod.Dir})
+
+		replaced, err := replacedModules(ctx, mod.Dir, mod.GoMod)
+		if err != nil {
+			return nil, err
+		}
+		mappings = append(mappings, replaced...)
+		mappings = append(mappings, vendoredModules(mod.Dir)...)
+	}
+
+	return mappings, nil
+}
+
+// replacedModules returns the modules replaced with a local directory in the go.mod
+func replacedModules(ctx context.Context, dir, gomod string) ([]pathMapping, error) {
+	if gomod == "" {
+		return nil, nil
+	}
+
+	out, err := goTool(ctx, nil, "mod", "edit", "-json", gomod)
+	if err != nil {
+		return nil, err
+	}
+
+	var modFile struct {
+		Replace []struct {
+			Old struct{ Path string }
+			New struct{ Path, Version string }
+		}
+	}
+	err = json.Unmarshal([]byte(out), &modFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading '%s': %w", gomod, err)
+	}
+
+	mappings := []pathMapping{}
+	for _, replace := range modFile.Replace {
+		// a replacement without version is a directory, relative to the module
+		if replace.New.Version != "" {
+			continue
+		}
+		replaceDir := replace.New.Path
+		if !filepath.IsAbs(replaceDir) {
+			replaceDir = filepath.Join(dir, replaceDir)
+		}
+		mappings = append(mappings, pathMapping{importPath: replace.Old.Path, dir: replaceDir})
+	}
+	return mappings, nil
+}
+
+// vendoredModules returns the modules listed in the vendor/modules.txt of the module
+func vendoredModules(dir string) []pathMapping {
+	f, err := os.Open(filepath.Join(dir, "vendor", "modules.txt"))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	mappings := []pathMapping{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// # module/path version [=> replacement]
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "#" {
+			continue
+		}
+		importPath := fields[1]
+		mappings = append(mappings, pathMapping{importPath: importPath, dir: filepath.Join(dir, "vendor", filepath.FromSlash(importPath))})
+	}
+	return mappings
+}
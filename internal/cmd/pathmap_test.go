@@ -0,0 +1,219 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// chdirTemp changes the working directory to a new temporary directory with the files, restoring it after the test
+func chdirTemp(t *testing.T, files ...string) string {
+	t.Helper()
+
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		path := filepath.Join(dir, filepath.FromSlash(file))
+		if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	return dir
+}
+
+func TestResolve(t *testing.T) {
+	dir := chdirTemp(t, "mod/pkg/a.go", "mod/sub/b.go", "sub/c.go")
+
+	tests := []struct {
+		name           string
+		mappings       []string
+		file           string
+		want           string
+		wantUnresolved bool
+	}{
+		{
+			name: "no mappings",
+			file: "example.com/mod/pkg/a.go",
+			want: "example.com/mod/pkg/a.go",
+		},
+		{
+			name:     "mapped module",
+			mappings: []string{"example.com/mod=" + filepath.Join(dir, "mod")},
+			file:     "example.com/mod/pkg/a.go",
+			want:     "./mod/pkg/a.go",
+		},
+		{
+			name:     "relative directory",
+			mappings: []string{"example.com/mod/=mod"},
+			file:     "example.com/mod/pkg/a.go",
+			want:     "./mod/pkg/a.go",
+		},
+		{
+			name:     "longest import path first",
+			mappings: []string{"example.com/mod=mod", "example.com/mod/sub=sub"},
+			file:     "example.com/mod/sub/c.go",
+			want:     "./sub/c.go",
+		},
+		{
+			name:     "file missing in the longest import path",
+			mappings: []string{"example.com/mod=mod", "example.com/mod/sub=sub"},
+			file:     "example.com/mod/sub/b.go",
+			want:     "./mod/sub/b.go",
+		},
+		{
+			name:           "import path prefix of another one",
+			mappings:       []string{"example.com/mod=mod"},
+			file:           "example.com/module/pkg/a.go",
+			want:           "example.com/module/pkg/a.go",
+			wantUnresolved: true,
+		},
+		{
+			name:           "file not found",
+			mappings:       []string{"example.com/mod=mod"},
+			file:           "example.com/mod/pkg/missing.go",
+			want:           "example.com/mod/pkg/missing.go",
+			wantUnresolved: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := newPathMapper(context.Background(), PathMapOptions{Mappings: tt.mappings})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			got := m.resolve(tt.file)
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if m.unresolved[tt.file] != tt.wantUnresolved {
+				t.Errorf("unresolved %v, want %v", m.unresolved[tt.file], tt.wantUnresolved)
+			}
+		})
+	}
+}
+
+func TestLocalPath(t *testing.T) {
+	dir := chdirTemp(t)
+
+	tests := []struct {
+		name string
+		path string
+		want string
+	}{
+		{
+			name: "absolute in the working directory",
+			path: filepath.Join(dir, "pkg", "a.go"),
+			want: "./pkg/a.go",
+		},
+		{
+			name: "absolute outside of the working directory",
+			path: filepath.Join(filepath.Dir(dir), "other", "a.go"),
+			want: "../other/a.go",
+		},
+		{
+			name: "relative",
+			path: filepath.Join("pkg", "a.go"),
+			want: "./pkg/a.go",
+		},
+		{
+			name: "relative to the parent",
+			path: filepath.Join("..", "a.go"),
+			want: "../a.go",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := localPath(tt.path)
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRewriteLines(t *testing.T) {
+	chdirTemp(t, "mod/pkg/a.go")
+
+	tests := []struct {
+		name           string
+		profile        string
+		want           string
+		wantUnresolved []string
+	}{
+		{
+			name:    "mode line",
+			profile: "mode: set\n",
+			want:    "mode: set\n",
+		},
+		{
+			name: "mapped blocks",
+			profile: "mode: atomic\n" +
+				"example.com/mod/pkg/a.go:3.10,5.2 1 1\n" +
+				"example.com/mod/pkg/a.go:7.10,9.2 2 0\n",
+			want: "mode: atomic\n" +
+				"./mod/pkg/a.go:3.10,5.2 1 1\n" +
+				"./mod/pkg/a.go:7.10,9.2 2 0\n",
+		},
+		{
+			name: "unresolved blocks are kept",
+			profile: "mode: set\n" +
+				"example.com/mod/pkg/a.go:3.10,5.2 1 1\n" +
+				"example.com/other/b.go:1.1,2.2 1 0\n",
+			want: "mode: set\n" +
+				"./mod/pkg/a.go:3.10,5.2 1 1\n" +
+				"example.com/other/b.go:1.1,2.2 1 0\n",
+			wantUnresolved: []string{"example.com/other/b.go"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := newPathMapper(context.Background(), PathMapOptions{Mappings: []string{"example.com/mod=mod"}})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var out bytes.Buffer
+			err = m.rewriteLines(strings.NewReader(tt.profile), &out)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if out.String() != tt.want {
+				t.Errorf("got %q, want %q", out.String(), tt.want)
+			}
+
+			unresolved := []string{}
+			for file := range m.unresolved {
+				unresolved = append(unresolved, file)
+			}
+			if tt.wantUnresolved == nil {
+				tt.wantUnresolved = []string{}
+			}
+			if !reflect.DeepEqual(unresolved, tt.wantUnresolved) {
+				t.Errorf("unresolved %v, want %v", unresolved, tt.wantUnresolved)
+			}
+		})
+	}
+}
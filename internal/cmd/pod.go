@@ -5,75 +5,51 @@ import (
 	"fmt"
 	"time"
 
-	"github.com/briandowns/spinner"
 	v1 "k8s.io/api/core/v1"
 	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 )
 
+// createCollectorPod creates the collector pod and waits for it to be ready.
+// It returns true if the pod was created, even if it did not become ready.
 func createCollectorPod(
 	ctx context.Context,
 	clientset kubernetes.Interface,
 	namespace string,
-) error {
+	opts CollectorOptions,
+	owners []metav1.OwnerReference,
+) (bool, error) {
 	podClient := clientset.CoreV1().Pods(namespace)
 
-	_, err := podClient.Create(ctx, &v1.Pod{
-		ObjectMeta: metav1.ObjectMeta{
-			Name: collectorName,
-		},
-		Spec: v1.PodSpec{
-			Containers: []v1.Container{{
-				Name:    collectorName,
-				Image:   "debian:stable-slim",
-				Command: []string{"/bin/bash", "-c", "--"},
-				Args:    []string{"while true; do sleep 30; done;"},
-				VolumeMounts: []v1.VolumeMount{{
-					Name:      volumeName,
-					MountPath: mountPath,
-				}},
-			}},
-			Volumes: []v1.Volume{{
-				Name: volumeName,
-				VolumeSource: v1.VolumeSource{
-					PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{
-						ClaimName: pvcName,
-					},
-				},
-			}},
-		},
-	}, metav1.CreateOptions{})
+	created := true
+	_, err := podClient.Create(ctx, newCollectorPod(opts, owners), metav1.CreateOptions{})
 
 	if err != nil {
 		if !k8serrors.IsAlreadyExists(err) {
-			return err
+			return false, err
 		}
+		created = false
 	}
+	trackResource(ctx, collectorResource, "created, waiting to be ready")
 
-	s := spinner.New(spinner.CharSets[9], 100*time.Millisecond)
+	s := newSpinner(ctx)
 	s.Suffix = " Creating Collector Pod"
 	s.Start()
 
 	start := time.Now()
 
-	for {
-		pod, err := podClient.Get(ctx, collectorName, metav1.GetOptions{})
-		if err != nil {
-			return err
-		}
-
-		if pod.Status.Phase == v1.PodRunning {
-			break
-		}
-
-		time.Sleep(time.Second)
+	err = waitForPod(ctx, clientset, namespace, collectorName, podReady)
+	s.Stop()
+	if err != nil {
+		return created, err
 	}
+	trackResource(ctx, collectorResource, "ready")
 
-	s.Stop()
-	fmt.Printf("✅ Collector Pod created [%v]\n", time.Since(start).Round(time.Second))
+	elapsed := time.Since(start).Round(time.Second)
+	report(ctx, Event{Resource: collectorResource, Action: "create", Duration: elapsed}, "✅ Collector Pod created [%v]", elapsed)
 
-	return nil
+	return created, nil
 }
 
 func deleteCollectorPod(
@@ -83,7 +59,7 @@ func deleteCollectorPod(
 ) error {
 	podClient := clientset.CoreV1().Pods(namespace)
 
-	s := spinner.New(spinner.CharSets[9], 100*time.Millisecond)
+	s := newSpinner(ctx)
 	s.Suffix = " Deleting Collector Pod"
 	s.Start()
 
@@ -92,29 +68,26 @@ func deleteCollectorPod(
 	err := podClient.Delete(ctx, collectorName, metav1.DeleteOptions{})
 	if err != nil {
 		if !k8serrors.IsNotFound(err) {
+			s.Stop()
 			return err
 		}
 	}
+	trackResource(ctx, collectorResource, "terminating")
 
-	for {
-		_, err = podClient.Get(ctx, collectorName, metav1.GetOptions{})
-		if err != nil {
-			if !k8serrors.IsNotFound(err) {
-				return err
-			}
-			break
-		}
-
-		time.Sleep(time.Second)
-	}
-
+	err = waitForPod(ctx, clientset, namespace, collectorName, podDeleted)
 	s.Stop()
+	if err != nil {
+		return err
+	}
+	trackResource(ctx, collectorResource, "deleted")
 
-	fmt.Printf("✅ Collector Pod deleted [%v]\n", time.Since(start).Round(time.Second))
+	elapsed := time.Since(start).Round(time.Second)
+	report(ctx, Event{Resource: collectorResource, Action: "delete", Duration: elapsed}, "✅ Collector Pod deleted [%v]", elapsed)
 
 	return nil
 }
 
+// deleteAndCreatePod replaces the pod with the provided one, that is created also if the old pod does not exist
 func deleteAndCreatePod(
 	ctx context.Context,
 	clientset kubernetes.Interface,
@@ -123,33 +96,32 @@ func deleteAndCreatePod(
 ) error {
 	podClient := clientset.CoreV1().Pods(namespace)
 
-	s := spinner.New(spinner.CharSets[9], 100*time.Millisecond)
+	s := newSpinner(ctx)
 	s.Suffix = " Deleting Pod"
 	s.Start()
 
 	start := time.Now()
 
+	resource := fmt.Sprintf("Pod '%s'", pod.Name)
+
 	err := podClient.Delete(ctx, pod.Name, metav1.DeleteOptions{})
 	if err != nil {
-		return err
-	}
-
-	for {
-		_, err := podClient.Get(ctx, pod.Name, metav1.GetOptions{})
-		if err != nil {
-			// pod was deleted
-			if k8serrors.IsNotFound(err) {
-				break
-			}
+		if !k8serrors.IsNotFound(err) {
+			s.Stop()
 			return err
 		}
-
-		time.Sleep(time.Second)
 	}
+	trackResource(ctx, resource, "terminating, not re-created yet")
 
+	err = waitForPod(ctx, clientset, namespace, pod.Name, podDeleted)
 	s.Stop()
+	if err != nil {
+		return err
+	}
+	trackResource(ctx, resource, "deleted, not re-created yet")
 
-	fmt.Printf("✅ Pod deleted [%v]\n", time.Since(start).Round(time.Second))
+	elapsed := time.Since(start).Round(time.Second)
+	report(ctx, Event{Resource: resource, Action: "delete", Duration: elapsed}, "✅ Pod deleted [%v]", elapsed)
 
 	s.Suffix = " Creating Pod"
 	s.Start()
@@ -160,25 +132,28 @@ func deleteAndCreatePod(
 
 	_, err = podClient.Create(ctx, pod, metav1.CreateOptions{})
 	if err != nil {
+		s.Stop()
 		return err
 	}
+	trackResource(ctx, resource, "re-created, waiting to be running")
 
-	for {
-		pod, err := podClient.Get(ctx, pod.Name, metav1.GetOptions{})
-		if err != nil {
-			return err
-		}
-
-		if pod.Status.Phase == v1.PodRunning {
-			break
-		}
-
-		time.Sleep(time.Second)
-	}
-
+	err = waitForPod(ctx, clientset, namespace, pod.Name, podRunning)
 	s.Stop()
+	if err != nil {
+		return err
+	}
+	trackResource(ctx, resource, "running")
 
-	fmt.Printf("✅ Pod created [%v]\n", time.Since(start).Round(time.Second))
+	elapsed = time.Since(start).Round(time.Second)
+	report(ctx, Event{Resource: resource, Action: "create", Duration: elapsed}, "✅ Pod created [%v]", elapsed)
 
 	return nil
 }
+
+// restorePod replaces the current pod with the original one
+func restorePod(ctx context.Context, clientset kubernetes.Interface, namespace string, original *v1.Pod) error {
+	pod := original.DeepCopy()
+	// let the scheduler choose the node, as done when patching the pod
+	pod.Spec.NodeName = ""
+	return deleteAndCreatePod(ctx, clientset, namespace, pod)
+}
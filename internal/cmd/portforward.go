@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/portforward"
+	"k8s.io/client-go/transport/spdy"
+)
+
+// portForward forwards a random local port to the pod port, returning the local port and a function to stop the forwarding
+func portForward(config *rest.Config, clientset kubernetes.Interface, namespace, podName string, podPort int) (uint16, func(), error) {
+	transport, upgrader, err := spdy.RoundTripperFor(config)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	url := clientset.CoreV1().RESTClient().
+		Post().
+		Resource("pods").
+		Namespace(namespace).
+		Name(podName).
+		SubResource("portforward").
+		URL()
+
+	dialer := spdy.NewDialer(upgrader, &http.Client{Transport: transport}, http.MethodPost, url)
+
+	stopCh := make(chan struct{})
+	readyCh := make(chan struct{})
+	var errOut bytes.Buffer
+
+	forwarder, err := portforward.NewOnAddresses(
+		dialer,
+		[]string{"127.0.0.1"},
+		[]string{fmt.Sprintf("0:%d", podPort)},
+		stopCh,
+		readyCh,
+		io.Discard,
+		&errOut,
+	)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	forwardErr := make(chan error, 1)
+	go func() {
+		forwardErr <- forwarder.ForwardPorts()
+	}()
+
+	select {
+	case err := <-forwardErr:
+		if err == nil {
+			err = errors.New(strings.TrimSpace(errOut.String()))
+		}
+		return 0, nil, fmt.Errorf("error forwarding port %d of pod '%s': %w", podPort, podName, err)
+	case <-readyCh:
+	}
+
+	ports, err := forwarder.GetPorts()
+	if err != nil {
+		close(stopCh)
+		return 0, nil, err
+	}
+
+	return ports[0].Local, func() { close(stopCh) }, nil
+}
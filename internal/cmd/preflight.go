@@ -0,0 +1,93 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// MissingPermission is a verb on a resource denied to the current user
+type MissingPermission struct {
+	Namespace string `json:"namespace,omitempty"`
+	Resource  string `json:"resource"`
+	Verb      string `json:"verb"`
+}
+
+// Preflight checks that the current user can use all the verbs on the resources needed by the command with the options
+// in the namespaces, all the namespaces if empty. It returns an error with the table of the missing permissions, before anything is changed.
+func Preflight(ctx context.Context, clientset kubernetes.Interface, command string, opts PermissionOptions, namespaces []string) error {
+	permissions, err := NeededPermissions(command, opts)
+	if err != nil {
+		return err
+	}
+	if len(namespaces) == 0 {
+		namespaces = []string{v1.NamespaceAll}
+	}
+
+	missing := []MissingPermission{}
+	checked := map[MissingPermission]bool{}
+
+	for _, namespace := range namespaces {
+		for _, p := range permissions {
+			for _, verb := range p.Verbs {
+				attributes := authorizationv1.ResourceAttributes{
+					Namespace:   namespace,
+					Verb:        verb,
+					Group:       p.Group,
+					Resource:    p.Resource,
+					Subresource: p.Subresource,
+				}
+				if p.Cluster {
+					attributes.Namespace = v1.NamespaceAll
+				}
+
+				key := MissingPermission{Namespace: attributes.Namespace, Resource: p.String(), Verb: verb}
+				if checked[key] {
+					continue
+				}
+				checked[key] = true
+
+				review, err := clientset.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx, &authorizationv1.SelfSubjectAccessReview{
+					Spec: authorizationv1.SelfSubjectAccessReviewSpec{ResourceAttributes: &attributes},
+				}, metav1.CreateOptions{})
+				if err != nil {
+					return fmt.Errorf("error checking the permissions: %w", err)
+				}
+
+				logger(ctx).Debug("access review", "namespace", key.Namespace, "resource", key.Resource, "verb", verb, "allowed", review.Status.Allowed)
+				if !review.Status.Allowed {
+					missing = append(missing, key)
+				}
+			}
+		}
+	}
+
+	if len(missing) == 0 {
+		report(ctx, Event{Action: "preflight"}, "✅ Permissions checked")
+		return nil
+	}
+	setResult(ctx, "missingPermissions", missing)
+
+	var sb strings.Builder
+	tw := tabwriter.NewWriter(&sb, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAMESPACE\tRESOURCE\tVERB")
+	for _, m := range missing {
+		namespace := m.Namespace
+		if namespace == v1.NamespaceAll {
+			namespace = "*"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", namespace, m.Resource, m.Verb)
+	}
+	tw.Flush()
+
+	return fmt.Errorf(
+		"missing %d permissions for '%s', nothing was changed:\n\n%s\n'gocoverkube rbac %s' prints the manifests granting all of them",
+		len(missing), command, sb.String(), command,
+	)
+}
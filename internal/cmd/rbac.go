@@ -0,0 +1,258 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	corev1ac "k8s.io/client-go/applyconfigurations/core/v1"
+	rbacv1ac "k8s.io/client-go/applyconfigurations/rbac/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// Permission is the access to a resource needed by a command
+type Permission struct {
+	Group       string
+	Resource    string
+	Subresource string
+	Verbs       []string
+	// Cluster is true for the cluster scoped resources, that can't be granted by a Role
+	Cluster bool
+
+	// needed returns if the permission is needed with the options, always if nil
+	needed func(PermissionOptions) bool
+}
+
+// PermissionOptions are the options of a command that change the permissions it needs
+type PermissionOptions struct {
+	// Deployments and Pods are true if there are deployments or pods in the targets
+	Deployments bool
+	Pods        bool
+	// StorageClass is true if the storage class is set, so the default one is not looked up
+	StorageClass bool
+	// Restart is true if the targets are restarted by collect
+	Restart bool
+}
+
+func withDeployments(o PermissionOptions) bool          { return o.Deployments }
+func withPods(o PermissionOptions) bool                 { return o.Pods }
+func withoutStorageClass(o PermissionOptions) bool      { return !o.StorageClass }
+func withRestart(o PermissionOptions) bool              { return o.Restart }
+func withRestartedDeployments(o PermissionOptions) bool { return o.Restart && o.Deployments }
+func withRestartedPods(o PermissionOptions) bool        { return o.Restart && o.Pods }
+
+func (p Permission) String() string {
+	resource := p.Resource
+	if p.Subresource != "" {
+		resource += "/" + p.Subresource
+	}
+	if p.Group != "" {
+		resource += "." + p.Group
+	}
+	return resource
+}
+
+// the lock is held by the commands that change the namespace
+var lockPermissions = []Permission{
+	{Group: "coordination.k8s.io", Resource: "leases", Verbs: []string{"get", "list", "watch", "create", "update", "delete"}},
+}
+
+// the events and the logs are attached to the errors of the pods that are not ready
+var diagnosticsPermissions = []Permission{
+	{Resource: "events", Verbs: []string{"list"}},
+	{Resource: "pods", Subresource: "log", Verbs: []string{"get"}},
+}
+
+// commandPermissions are the permissions needed by each command, in the namespace of the targets.
+// The manifests grant all of them, the preflight checks only the ones needed with the options.
+var commandPermissions = map[string][]Permission{
+	"init": concat(lockPermissions, diagnosticsPermissions, []Permission{
+		{Group: "apps", Resource: "deployments", Verbs: []string{"get", "list", "watch", "patch", "update"}, needed: withDeployments},
+		// the collector pod is created, and deleted on rollback
+		{Resource: "pods", Verbs: []string{"get", "list", "watch", "create", "delete"}},
+		// the coverage meta-data is looked for on the volume, through the collector
+		{Resource: "pods", Subresource: "portforward", Verbs: []string{"create"}},
+		{Resource: "pods", Subresource: "exec", Verbs: []string{"create"}},
+		{Resource: "configmaps", Verbs: []string{"get", "create", "update", "delete"}},
+		{Resource: "secrets", Verbs: []string{"get", "create", "delete"}},
+		{Resource: "persistentvolumeclaims", Verbs: []string{"get", "create", "delete"}},
+		{Group: "storage.k8s.io", Resource: "storageclasses", Verbs: []string{"list"}, Cluster: true, needed: withoutStorageClass},
+	}),
+	"collect": concat(lockPermissions, []Permission{
+		{Resource: "events", Verbs: []string{"list"}, needed: withRestart},
+		{Resource: "pods", Subresource: "log", Verbs: []string{"get"}, needed: withRestart},
+		{Group: "apps", Resource: "deployments", Verbs: []string{"get", "list", "watch", "patch"}, needed: withRestartedDeployments},
+		{Resource: "pods", Verbs: []string{"get"}},
+		{Resource: "pods", Verbs: []string{"list", "watch"}, needed: withRestart},
+		{Resource: "pods", Verbs: []string{"create", "delete"}, needed: withRestartedPods},
+		{Resource: "pods", Subresource: "portforward", Verbs: []string{"create"}},
+		{Resource: "pods", Subresource: "exec", Verbs: []string{"create"}},
+		{Resource: "secrets", Verbs: []string{"get"}},
+		{Resource: "persistentvolumeclaims", Verbs: []string{"get"}},
+	}),
+	"clear": concat(lockPermissions, diagnosticsPermissions, []Permission{
+		{Group: "apps", Resource: "deployments", Verbs: []string{"get", "list", "watch", "patch", "update"}, needed: withDeployments},
+		// the collector pod is deleted, the target pods are recreated
+		{Resource: "pods", Verbs: []string{"get", "list", "watch", "delete"}},
+		{Resource: "pods", Verbs: []string{"create"}, needed: withPods},
+		{Resource: "configmaps", Verbs: []string{"get", "update", "delete"}},
+		{Resource: "secrets", Verbs: []string{"delete"}},
+		{Resource: "persistentvolumeclaims", Verbs: []string{"delete"}},
+	}),
+	"gc": {
+		{Group: "coordination.k8s.io", Resource: "leases", Verbs: []string{"list", "delete"}},
+		{Resource: "configmaps", Verbs: []string{"list", "delete"}},
+		{Resource: "pods", Verbs: []string{"get", "list", "delete"}},
+		{Resource: "secrets", Verbs: []string{"list", "delete"}},
+		{Resource: "persistentvolumeclaims", Verbs: []string{"list", "delete"}},
+		{Group: "apps", Resource: "deployments", Verbs: []string{"get", "list"}},
+	},
+	"force-unlock": {
+		{Group: "coordination.k8s.io", Resource: "leases", Verbs: []string{"get", "delete"}},
+	},
+}
+
+// RBACCommands returns the commands whose permissions are known, in order
+func RBACCommands() []string {
+	commands := []string{}
+	for command := range commandPermissions {
+		commands = append(commands, command)
+	}
+	sort.Strings(commands)
+	return commands
+}
+
+// Permissions returns the permissions needed by the commands, merging the verbs on the same resource
+func Permissions(commands []string) ([]Permission, error) {
+	merged := map[string]*Permission{}
+
+	for _, command := range commands {
+		permissions, found := commandPermissions[command]
+		if !found {
+			return nil, fmt.Errorf("unknown command '%s', must be one of '%s'", command, strings.Join(RBACCommands(), "', '"))
+		}
+
+		for _, p := range permissions {
+			m, found := merged[p.String()]
+			if !found {
+				m = &Permission{Group: p.Group, Resource: p.Resource, Subresource: p.Subresource, Cluster: p.Cluster}
+				merged[p.String()] = m
+			}
+			m.Verbs = union(m.Verbs, p.Verbs)
+		}
+	}
+
+	permissions := []Permission{}
+	for _, p := range merged {
+		permissions = append(permissions, *p)
+	}
+	sort.Slice(permissions, func(i, j int) bool {
+		return permissions[i].String() < permissions[j].String()
+	})
+
+	return permissions, nil
+}
+
+// NeededPermissions returns the permissions needed by the command with the options
+func NeededPermissions(command string, opts PermissionOptions) ([]Permission, error) {
+	permissions, found := commandPermissions[command]
+	if !found {
+		return nil, fmt.Errorf("unknown command '%s', must be one of '%s'", command, strings.Join(RBACCommands(), "', '"))
+	}
+
+	needed := []Permission{}
+	for _, p := range permissions {
+		if p.needed == nil || p.needed(opts) {
+			needed = append(needed, p)
+		}
+	}
+	return needed, nil
+}
+
+// WriteRBACManifests writes the ServiceAccount, and the Role and RoleBinding granting it the permissions of the commands
+// in the namespace. The cluster scoped permissions, or all of them if clusterWide, are granted by a ClusterRole.
+func WriteRBACManifests(w io.Writer, namespace, name string, commands []string, clusterWide bool) error {
+	permissions, err := Permissions(commands)
+	if err != nil {
+		return err
+	}
+
+	// the cluster scoped names are unique for each namespace
+	clusterName := name + "-" + namespace
+	labels := managedLabels("rbac")
+	subject := rbacv1ac.Subject().WithKind("ServiceAccount").WithName(name).WithNamespace(namespace)
+
+	namespaced, cluster := []*rbacv1ac.PolicyRuleApplyConfiguration{}, []*rbacv1ac.PolicyRuleApplyConfiguration{}
+	for _, p := range permissions {
+		if p.Cluster || clusterWide {
+			cluster = append(cluster, policyRule(p))
+		} else {
+			namespaced = append(namespaced, policyRule(p))
+		}
+	}
+
+	manifests := []any{
+		corev1ac.ServiceAccount(name, namespace).WithLabels(labels),
+	}
+	if len(namespaced) > 0 {
+		manifests = append(manifests,
+			rbacv1ac.Role(name, namespace).WithLabels(labels).WithRules(namespaced...),
+			rbacv1ac.RoleBinding(name, namespace).WithLabels(labels).
+				WithRoleRef(rbacv1ac.RoleRef().WithAPIGroup("rbac.authorization.k8s.io").WithKind("Role").WithName(name)).
+				WithSubjects(subject),
+		)
+	}
+	if len(cluster) > 0 {
+		manifests = append(manifests,
+			rbacv1ac.ClusterRole(clusterName).WithLabels(labels).WithRules(cluster...),
+			rbacv1ac.ClusterRoleBinding(clusterName).WithLabels(labels).
+				WithRoleRef(rbacv1ac.RoleRef().WithAPIGroup("rbac.authorization.k8s.io").WithKind("ClusterRole").WithName(clusterName)).
+				WithSubjects(subject),
+		)
+	}
+
+	for i, manifest := range manifests {
+		data, err := yaml.Marshal(manifest)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			fmt.Fprintln(w, "---")
+		}
+		fmt.Fprint(w, string(data))
+	}
+
+	return nil
+}
+
+func policyRule(p Permission) *rbacv1ac.PolicyRuleApplyConfiguration {
+	resource := p.Resource
+	if p.Subresource != "" {
+		resource += "/" + p.Subresource
+	}
+	return rbacv1ac.PolicyRule().WithAPIGroups(p.Group).WithResources(resource).WithVerbs(p.Verbs...)
+}
+
+func concat(permissions ...[]Permission) []Permission {
+	all := []Permission{}
+	for _, p := range permissions {
+		all = append(all, p...)
+	}
+	return all
+}
+
+// union returns the values of a, followed by the ones of b not in a
+func union(a, b []string) []string {
+	seen := map[string]bool{}
+	for _, v := range a {
+		seen[v] = true
+	}
+	for _, v := range b {
+		if !seen[v] {
+			a = append(a, v)
+			seen[v] = true
+		}
+	}
+	return a
+}
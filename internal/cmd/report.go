@@ -0,0 +1,321 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+const (
+	reportDataDir       = "covdata"
+	reportServicesDir   = "services"
+	reportAttribution   = "attribution.txt"
+	reportBlocks        = "blocks.txt"
+	reportNoServiceMark = "-"
+)
+
+// service is the coverage data collected from the binary of a service
+type service struct {
+	name    string
+	dir     string
+	profile string
+	blocks  map[string]profileBlock
+}
+
+// MergeServices merges the coverage data collected from the binaries of different services into outDir,
+// combining the packages they share. It writes the merged data with its text profile, a text profile for each service,
+// the coverage of each package by each service, and the services that covered each block.
+// The services are named after their directories, that can also be the output directories of 'collect --watch'.
+func MergeServices(ctx context.Context, outDir string, serviceDirs []string, pathMap PathMapOptions) error {
+	err := checkGoToolchain()
+	if err != nil {
+		return err
+	}
+
+	mapper, err := newPathMapper(ctx, pathMap)
+	if err != nil {
+		return err
+	}
+
+	services, err := newServices(serviceDirs)
+	if err != nil {
+		return err
+	}
+
+	dataDirs := []string{}
+	for _, s := range services {
+		dataDirs = append(dataDirs, s.dir)
+	}
+
+	dataDir := filepath.Join(outDir, reportDataDir)
+	err = combineCoverage(ctx, dataDir, dataDirs...)
+	if err != nil {
+		return err
+	}
+
+	profile := filepath.Join(outDir, profileFile)
+	err = textProfile(ctx, dataDir, profile, mapper)
+	if err != nil {
+		return err
+	}
+
+	merged, err := readProfile(profile)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Join(outDir, reportServicesDir), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range services {
+		s.profile = filepath.Join(outDir, reportServicesDir, s.name+".out")
+		err = textProfile(ctx, s.dir, s.profile, mapper)
+		if err != nil {
+			return fmt.Errorf("service '%s': %w", s.name, err)
+		}
+
+		s.blocks, err = readProfile(s.profile)
+		if err != nil {
+			return fmt.Errorf("service '%s': %w", s.name, err)
+		}
+
+		percent := blocksPercent(s.blocks, nil)
+		report(ctx, Event{Resource: fmt.Sprintf("Service '%s'", s.name), Action: "report"}, "📈 Service '%s': coverage %.1f%%, profile written at '%s'", s.name, percent, s.profile)
+	}
+	mapper.warnUnresolved(ctx)
+
+	attribution := filepath.Join(outDir, reportAttribution)
+	err = writeFile(attribution, func(f *os.File) error {
+		return writeAttribution(f, merged, services)
+	})
+	if err != nil {
+		return err
+	}
+
+	blocks := filepath.Join(outDir, reportBlocks)
+	err = writeFile(blocks, func(f *os.File) error {
+		return writeBlocks(f, merged, services)
+	})
+	if err != nil {
+		return err
+	}
+
+	percent := blocksPercent(merged, nil)
+	report(ctx, Event{Resource: fmt.Sprintf("Profile '%s'", profile), Action: "merge"}, "📈 Coverage of %d services %.1f%%, profile written at '%s'", len(services), percent, profile)
+	report(ctx, Event{Resource: fmt.Sprintf("Report '%s'", attribution), Action: "report"}, "📊 Coverage by service written at '%s' and '%s'", attribution, blocks)
+
+	setResult(ctx, "coveragePercent", percent)
+	setResult(ctx, "profile", profile)
+	setResult(ctx, "mergedDir", dataDir)
+	setResult(ctx, "attribution", attribution)
+	setResult(ctx, "blocks", blocks)
+
+	return nil
+}
+
+// newServices returns the services of the directories, that must have coverage data and different names.
+// The coverage data of the output directory of 'collect --watch' is in its raw subdirectory.
+func newServices(dirs []string) ([]*service, error) {
+	services := []*service{}
+	names := map[string]string{}
+
+	for _, dir := range dirs {
+		name := filepath.Base(filepath.Clean(dir))
+		if other, found := names[name]; found {
+			return nil, fmt.Errorf("directories '%s' and '%s' have the same name, the services are named after them", other, dir)
+		}
+		names[name] = dir
+
+		dataDir := dir
+		found, err := hasCoverageMeta(dataDir)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			dataDir = filepath.Join(dir, watchRawDir)
+			found, _ = hasCoverageMeta(dataDir)
+		}
+		if !found {
+			return nil, fmt.Errorf("no coverage meta-data found in '%s'", dir)
+		}
+
+		services = append(services, &service{name: name, dir: dataDir})
+	}
+
+	return services, nil
+}
+
+// hasCoverageMeta returns true if the directory has coverage meta-data files
+func hasCoverageMeta(dir string) (bool, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return false, err
+	}
+
+	paths := []string{}
+	for _, entry := range entries {
+		paths = append(paths, entry.Name())
+	}
+	return countPaths(paths, covMetaPrefix) > 0, nil
+}
+
+// writeAttribution writes the coverage of each package, and the coverage of its statements by each service.
+// The services whose binary doesn't include the package are marked with '-'.
+func writeAttribution(w io.Writer, merged map[string]profileBlock, services []*service) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	header := []string{"PACKAGE", "STATEMENTS", "COVERAGE"}
+	for _, s := range services {
+		header = append(header, s.name)
+	}
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+
+	packages := map[string]bool{}
+	for _, b := range merged {
+		packages[path.Dir(b.file)] = true
+	}
+
+	for _, pkg := range sortedKeys(packages) {
+		inPackage := func(b profileBlock) bool { return path.Dir(b.file) == pkg }
+
+		var stmts int64
+		for _, b := range merged {
+			if inPackage(b) {
+				stmts += b.stmts
+			}
+		}
+
+		row := []string{pkg, fmt.Sprint(stmts), fmt.Sprintf("%.1f%%", blocksPercent(merged, inPackage))}
+		for _, s := range services {
+			if !hasBlock(s.blocks, inPackage) {
+				row = append(row, reportNoServiceMark)
+				continue
+			}
+			// the statements not in the binary of the service count as not covered
+			row = append(row, fmt.Sprintf("%.1f%%", percentOf(coveredStmts(s.blocks, inPackage), stmts)))
+		}
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+
+	return tw.Flush()
+}
+
+// writeBlocks writes each block of the merged profile, with the services that covered it
+func writeBlocks(w io.Writer, merged map[string]profileBlock, services []*service) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "BLOCK\tSTATEMENTS\tSERVICES")
+
+	positions := []string{}
+	for position := range merged {
+		positions = append(positions, position)
+	}
+	sort.Slice(positions, func(i, j int) bool {
+		return lessPosition(positions[i], positions[j])
+	})
+
+	for _, position := range positions {
+		covering := []string{}
+		for _, s := range services {
+			if s.blocks[position].covered {
+				covering = append(covering, s.name)
+			}
+		}
+
+		names := reportNoServiceMark
+		if len(covering) > 0 {
+			names = strings.Join(covering, ",")
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\n", position, merged[position].stmts, names)
+	}
+
+	return tw.Flush()
+}
+
+// lessPosition orders the positions 'name.go:line.column,line.column' by file, and then by line and column
+func lessPosition(a, b string) bool {
+	fileA, rangeA := cutLast(a, ":")
+	fileB, rangeB := cutLast(b, ":")
+	if fileA != fileB {
+		return fileA < fileB
+	}
+
+	var lineA, colA, lineB, colB int
+	fmt.Sscanf(rangeA, "%d.%d", &lineA, &colA)
+	fmt.Sscanf(rangeB, "%d.%d", &lineB, &colB)
+	if lineA != lineB {
+		return lineA < lineB
+	}
+	if colA != colB {
+		return colA < colB
+	}
+	return rangeA < rangeB
+}
+
+// cutLast slices s around the last instance of sep
+func cutLast(s, sep string) (before, after string) {
+	if i := strings.LastIndex(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):]
+	}
+	return s, ""
+}
+
+// blocksPercent returns the percentage of statements covered in the blocks matching the filter, all of them if nil
+func blocksPercent(blocks map[string]profileBlock, filter func(profileBlock) bool) float64 {
+	var total int64
+	for _, b := range blocks {
+		if filter == nil || filter(b) {
+			total += b.stmts
+		}
+	}
+	return percentOf(coveredStmts(blocks, filter), total)
+}
+
+func coveredStmts(blocks map[string]profileBlock, filter func(profileBlock) bool) int64 {
+	var covered int64
+	for _, b := range blocks {
+		if b.covered && (filter == nil || filter(b)) {
+			covered += b.stmts
+		}
+	}
+	return covered
+}
+
+func hasBlock(blocks map[string]profileBlock, filter func(profileBlock) bool) bool {
+	for _, b := range blocks {
+		if filter(b) {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// writeFile creates the file, writing it with the write function
+func writeFile(name string, write func(f *os.File) error) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+
+	err = write(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,206 @@
+package cmd
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNewServices(t *testing.T) {
+	dir := t.TempDir()
+	for _, file := range []string{
+		"collected/svc-a/covmeta.1",
+		"collected/svc-a/covcounters.1.1.1",
+		"watched/svc-b/raw/covmeta.2",
+		"watched/svc-b/merged/covmeta.2",
+		"other/svc-a/covmeta.3",
+		"empty/svc-c/coverage.out",
+	} {
+		path := filepath.Join(dir, filepath.FromSlash(file))
+		if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		dirs     []string
+		wantDirs map[string]string
+		wantErr  string
+	}{
+		{
+			name: "collect and watch output directories",
+			dirs: []string{"collected/svc-a", "watched/svc-b/"},
+			wantDirs: map[string]string{
+				"svc-a": "collected/svc-a",
+				"svc-b": "watched/svc-b/raw",
+			},
+		},
+		{
+			name:    "same name",
+			dirs:    []string{"collected/svc-a", "other/svc-a"},
+			wantErr: "have the same name",
+		},
+		{
+			name:    "no coverage meta-data",
+			dirs:    []string{"empty/svc-c"},
+			wantErr: "no coverage meta-data found",
+		},
+		{
+			name:    "missing directory",
+			dirs:    []string{"missing/svc-d"},
+			wantErr: "no such file or directory",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dirs := []string{}
+			for _, d := range tt.dirs {
+				dirs = append(dirs, filepath.Join(dir, filepath.FromSlash(d)))
+			}
+
+			services, err := newServices(dirs)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			got := map[string]string{}
+			for _, s := range services {
+				rel, _ := filepath.Rel(dir, s.dir)
+				got[s.name] = filepath.ToSlash(rel)
+			}
+			if !reflect.DeepEqual(got, tt.wantDirs) {
+				t.Errorf("got %v, want %v", got, tt.wantDirs)
+			}
+		})
+	}
+}
+
+func TestWriteAttribution(t *testing.T) {
+	merged := map[string]profileBlock{
+		"example.com/a/x.go:1.1,2.2": {file: "example.com/a/x.go", stmts: 2, covered: true},
+		"example.com/a/x.go:3.1,4.2": {file: "example.com/a/x.go", stmts: 2},
+		"example.com/b/y.go:1.1,2.2": {file: "example.com/b/y.go", stmts: 1, covered: true},
+		"example.com/b/y.go:3.1,4.2": {file: "example.com/b/y.go", stmts: 3, covered: true},
+	}
+
+	tests := []struct {
+		name     string
+		services []*service
+		want     [][]string
+	}{
+		{
+			name: "no services",
+			want: [][]string{
+				{"PACKAGE", "STATEMENTS", "COVERAGE"},
+				{"example.com/a", "4", "50.0%"},
+				{"example.com/b", "4", "100.0%"},
+			},
+		},
+		{
+			name: "services with shared and missing packages",
+			services: []*service{
+				{name: "svc-a", blocks: map[string]profileBlock{
+					"example.com/a/x.go:1.1,2.2": merged["example.com/a/x.go:1.1,2.2"],
+					"example.com/a/x.go:3.1,4.2": merged["example.com/a/x.go:3.1,4.2"],
+					"example.com/b/y.go:1.1,2.2": merged["example.com/b/y.go:1.1,2.2"],
+				}},
+				{name: "svc-b", blocks: map[string]profileBlock{
+					"example.com/b/y.go:1.1,2.2": {file: "example.com/b/y.go", stmts: 1},
+					"example.com/b/y.go:3.1,4.2": merged["example.com/b/y.go:3.1,4.2"],
+				}},
+			},
+			want: [][]string{
+				{"PACKAGE", "STATEMENTS", "COVERAGE", "svc-a", "svc-b"},
+				{"example.com/a", "4", "50.0%", "50.0%", "-"},
+				// the block of y.go not in the binary of svc-a counts as not covered
+				{"example.com/b", "4", "100.0%", "25.0%", "75.0%"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			err := writeAttribution(&out, merged, tt.services)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			got := [][]string{}
+			for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+				got = append(got, strings.Fields(line))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLessPosition(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want bool
+	}{
+		{
+			name: "different files",
+			a:    "example.com/a/x.go:9.1,10.2",
+			b:    "example.com/a/y.go:1.1,2.2",
+			want: true,
+		},
+		{
+			name: "lines compared as numbers",
+			a:    "x.go:9.1,10.2",
+			b:    "x.go:10.1,11.2",
+			want: true,
+		},
+		{
+			name: "later line",
+			a:    "x.go:10.1,11.2",
+			b:    "x.go:9.1,10.2",
+			want: false,
+		},
+		{
+			name: "columns compared as numbers",
+			a:    "x.go:3.9,4.2",
+			b:    "x.go:3.10,4.2",
+			want: true,
+		},
+		{
+			name: "same start",
+			a:    "x.go:3.1,4.2",
+			b:    "x.go:3.1,5.2",
+			want: true,
+		},
+		{
+			name: "same position",
+			a:    "x.go:3.1,4.2",
+			b:    "x.go:3.1,4.2",
+			want: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := lessPosition(tt.a, tt.b)
+			if got != tt.want {
+				t.Errorf("lessPosition(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+			}
+		})
+	}
+}
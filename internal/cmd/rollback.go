@@ -0,0 +1,106 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// rollback records the changes applied to the cluster, to undo them if a command fails halfway
+type rollback struct {
+	steps []rollbackStep
+}
+
+type rollbackStep struct {
+	description string
+	undo        func(ctx context.Context) error
+}
+
+// Add records a change, with the function that undoes it
+func (r *rollback) Add(description string, undo func(ctx context.Context) error) {
+	r.steps = append(r.steps, rollbackStep{description: description, undo: undo})
+}
+
+// Run undoes the recorded changes in reverse order. It runs even if the context was cancelled,
+// since it is what leaves the cluster in a consistent state after an interruption.
+func (r *rollback) Run(ctx context.Context) error {
+	if len(r.steps) == 0 {
+		return nil
+	}
+
+	message := "↩️  Rolling back the applied changes"
+	if errors.Is(context.Cause(ctx), context.Canceled) {
+		message += ", interrupt again to exit without completing it"
+	}
+
+	ctx = context.WithoutCancel(ctx)
+	report(ctx, Event{Action: "rollback"}, "%s", message)
+
+	var errs []error
+	for i := len(r.steps) - 1; i >= 0; i-- {
+		step := r.steps[i]
+
+		err := step.undo(ctx)
+		if err != nil {
+			report(ctx, Event{Action: "rollback", Result: "error"}, "❌ Rollback failed: %s: %s", step.description, err)
+			errs = append(errs, fmt.Errorf("%s: %w", step.description, err))
+			continue
+		}
+		report(ctx, Event{Action: "rollback"}, "↩️  Rolled back: %s", step.description)
+	}
+
+	return errors.Join(errs...)
+}
+
+// withRollback runs the rollback if the error is not nil, adding the rollback errors to it
+func withRollback(ctx context.Context, rb *rollback, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	rollbackErr := rb.Run(ctx)
+	if rollbackErr != nil {
+		return fmt.Errorf("%w\nrollback failed, the cluster could be left in an inconsistent state: %w", err, rollbackErr)
+	}
+	return err
+}
+
+// backupPod saves the pod manifest in the user cache directory, returning the path of the file
+func backupPod(pod *v1.Pod) (string, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+
+	backupDir := filepath.Join(cacheDir, "gocoverkube", "backup", pod.Namespace)
+	err = os.MkdirAll(backupDir, 0o700)
+	if err != nil {
+		return "", err
+	}
+
+	backup := pod.DeepCopy()
+	backup.APIVersion = "v1"
+	backup.Kind = "Pod"
+	backup.ResourceVersion = ""
+	backup.UID = ""
+	backup.Status = v1.PodStatus{}
+
+	data, err := yaml.Marshal(backup)
+	if err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(backupDir, fmt.Sprintf("%s-%s.yaml", pod.Name, time.Now().Format("20060102-150405")))
+	err = os.WriteFile(path, data, 0o600)
+	if err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
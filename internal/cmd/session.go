@@ -0,0 +1,148 @@
+package cmd
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	managedByLabel = "app.kubernetes.io/managed-by"
+	managedByValue = "gocoverkube"
+	componentLabel = "app.kubernetes.io/component"
+
+	// sessionName is the ConfigMap owning the resources created by init, deleting it cleans them up
+	sessionName       = "gocoverkube-session"
+	sessionTargetsKey = "targets"
+	sessionCreatedKey = "created-at"
+
+	sessionResource = "Session ConfigMap '" + sessionName + "'"
+)
+
+// managedLabels returns the labels of the resources created by gocoverkube
+func managedLabels(component string) map[string]string {
+	return map[string]string{
+		managedByLabel: managedByValue,
+		componentLabel: component,
+	}
+}
+
+// createSession creates the session ConfigMap for the target, as 'deployment/name' or 'pod/name',
+// or adds the target to the existing one. It returns the session, and true if it was created.
+func createSession(ctx context.Context, clientset kubernetes.Interface, namespace, target string) (*v1.ConfigMap, bool, error) {
+	cmClient := clientset.CoreV1().ConfigMaps(namespace)
+
+	session, err := cmClient.Create(ctx, &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   sessionName,
+			Labels: managedLabels("session"),
+		},
+		Data: map[string]string{
+			sessionTargetsKey: target,
+			sessionCreatedKey: time.Now().UTC().Format(time.RFC3339),
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		if !k8serrors.IsAlreadyExists(err) {
+			return nil, false, err
+		}
+
+		session, err = cmClient.Get(ctx, sessionName, metav1.GetOptions{})
+		if err != nil {
+			return nil, false, err
+		}
+		targets := sessionTargets(session)
+		for _, t := range targets {
+			if t == target {
+				return session, false, nil
+			}
+		}
+
+		if session.Data == nil {
+			session.Data = map[string]string{}
+		}
+		session.Data[sessionTargetsKey] = strings.Join(append(targets, target), "\n")
+		session, err = cmClient.Update(ctx, session, metav1.UpdateOptions{})
+		return session, false, err
+	}
+	trackResource(ctx, sessionResource, "created")
+
+	return session, true, nil
+}
+
+// deleteSession deletes the session ConfigMap. The resources it still owns are deleted by the garbage collector.
+func deleteSession(ctx context.Context, clientset kubernetes.Interface, namespace string) error {
+	propagation := metav1.DeletePropagationBackground
+	err := clientset.CoreV1().ConfigMaps(namespace).Delete(ctx, sessionName, metav1.DeleteOptions{
+		PropagationPolicy: &propagation,
+	})
+	if err != nil {
+		if !k8serrors.IsNotFound(err) {
+			return err
+		}
+	}
+	trackResource(ctx, sessionResource, "deleted")
+
+	return nil
+}
+
+// removeSessionTarget removes the target from the session, returning the other targets of the session
+func removeSessionTarget(ctx context.Context, clientset kubernetes.Interface, namespace, target string) ([]string, error) {
+	cmClient := clientset.CoreV1().ConfigMaps(namespace)
+	remaining := []string{}
+
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		session, err := cmClient.Get(ctx, sessionName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		remaining = []string{}
+		for _, t := range sessionTargets(session) {
+			if t != target {
+				remaining = append(remaining, t)
+			}
+		}
+		// the session is deleted with the other resources
+		if len(remaining) == 0 {
+			return nil
+		}
+
+		session.Data[sessionTargetsKey] = strings.Join(remaining, "\n")
+		_, err = cmClient.Update(ctx, session, metav1.UpdateOptions{})
+		return err
+	})
+	// created by an older version, without a session
+	if k8serrors.IsNotFound(err) {
+		return nil, nil
+	}
+
+	return remaining, err
+}
+
+// ownerReferences returns the owner references to set on the resources of the session
+func ownerReferences(session *v1.ConfigMap) []metav1.OwnerReference {
+	return []metav1.OwnerReference{{
+		APIVersion: "v1",
+		Kind:       "ConfigMap",
+		Name:       session.Name,
+		UID:        session.UID,
+	}}
+}
+
+// sessionTargets returns the instrumented workloads of the session
+func sessionTargets(session *v1.ConfigMap) []string {
+	targets := []string{}
+	for _, t := range strings.Split(session.Data[sessionTargetsKey], "\n") {
+		if t != "" {
+			targets = append(targets, t)
+		}
+	}
+	return targets
+}
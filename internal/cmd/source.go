@@ -0,0 +1,257 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+	"k8s.io/client-go/transport/spdy"
+
+	"github.com/enrichman/gocoverkube/internal/collector"
+)
+
+// listFilesScript prints the size, the sha256 checksum and the relative path of every file under the directory $1
+const listFilesScript = `cd "$1" && find . -type f | while read -r f; do
+	printf '%s %s %s\n' "$(wc -c < "$f")" "$(sha256sum < "$f" | cut -d' ' -f1)" "${f#./}"
+done`
+
+// fileSource gives access to the files of the coverage volume
+type fileSource interface {
+	List(ctx context.Context) ([]remoteFile, error)
+	// Open returns the content of the file starting from offset, gzipped if compress is true
+	Open(ctx context.Context, name string, offset int64, compress bool) (io.ReadCloser, error)
+	Delete(ctx context.Context, name string) error
+	// Archive returns a tar.gz archive of all the files
+	Archive(ctx context.Context) (io.ReadCloser, error)
+	Close() error
+}
+
+type remoteFile struct {
+	path     string
+	size     int64
+	checksum string
+}
+
+// newCollectorSource returns a fileSource for the collector pod, using the collector API if available
+// or falling back to the shell utilities of the collector image.
+func newCollectorSource(ctx context.Context, config *rest.Config, clientset kubernetes.Interface, namespace string) (fileSource, error) {
+	pod, err := clientset.CoreV1().Pods(namespace).Get(ctx, collectorName, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	if !hasCollectorAPI(pod) {
+		return &execSource{
+			restConfig: config,
+			clientset:  clientset,
+			namespace:  namespace,
+			pod:        collectorName,
+			container:  collectorName,
+			dir:        mountPath,
+		}, nil
+	}
+
+	token, err := collectorToken(ctx, clientset, namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	localPort, stop, err := portForward(config, clientset, namespace, collectorName, collector.Port)
+	if err != nil {
+		return nil, err
+	}
+
+	return &apiSource{
+		Client: collector.NewClient(fmt.Sprintf("http://127.0.0.1:%d", localPort), token),
+		stop:   stop,
+	}, nil
+}
+
+// apiSource uses the collector API through a port-forward
+type apiSource struct {
+	*collector.Client
+	stop func()
+}
+
+func (s *apiSource) List(ctx context.Context) ([]remoteFile, error) {
+	files, err := s.Client.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	remoteFiles := []remoteFile{}
+	for _, f := range files {
+		remoteFiles = append(remoteFiles, remoteFile{
+			path:     f.Name,
+			size:     f.Size,
+			checksum: f.SHA256,
+		})
+	}
+
+	return remoteFiles, nil
+}
+
+func (s *apiSource) Close() error {
+	s.stop()
+	return nil
+}
+
+// execSource streams the files over the exec subresource, using the shell utilities of the container
+type execSource struct {
+	restConfig *rest.Config
+	clientset  kubernetes.Interface
+	namespace  string
+	pod        string
+	container  string
+	dir        string
+}
+
+func (s *execSource) List(ctx context.Context) ([]remoteFile, error) {
+	var stdout bytes.Buffer
+	err := s.exec(ctx, []string{"sh", "-c", listFilesScript, "sh", s.dir}, &stdout)
+	if err != nil {
+		return nil, fmt.Errorf("error listing files in '%s': %w", s.dir, err)
+	}
+
+	files := []remoteFile{}
+
+	scanner := bufio.NewScanner(&stdout)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), " ", 3)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("unexpected file entry '%s'", scanner.Text())
+		}
+
+		size, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected file size '%s': %w", fields[0], err)
+		}
+
+		files = append(files, remoteFile{
+			path:     fields[2],
+			size:     size,
+			checksum: fields[1],
+		})
+	}
+
+	return files, scanner.Err()
+}
+
+func (s *execSource) Open(ctx context.Context, name string, offset int64, compress bool) (io.ReadCloser, error) {
+	script := `tail -c +"$1" "$2"`
+	if compress {
+		script += " | gzip -c"
+	}
+	// tail offsets are 1-based
+	command := []string{"sh", "-c", script, "sh", strconv.FormatInt(offset+1, 10), path.Join(s.dir, name)}
+
+	return s.stream(ctx, command), nil
+}
+
+func (s *execSource) Delete(ctx context.Context, name string) error {
+	return s.exec(ctx, []string{"rm", "-f", "--", path.Join(s.dir, name)}, io.Discard)
+}
+
+func (s *execSource) Archive(ctx context.Context) (io.ReadCloser, error) {
+	return s.stream(ctx, []string{"tar", "czf", "-", "-C", s.dir, "."}), nil
+}
+
+func (s *execSource) Close() error {
+	return nil
+}
+
+// stream runs the command in background, returning its stdout
+func (s *execSource) stream(ctx context.Context, command []string) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(s.exec(ctx, command, pw))
+	}()
+	return pr
+}
+
+// exec runs the command in the container, writing its stdout to the writer.
+// The stderr is returned in the error if the command fails.
+func (s *execSource) exec(ctx context.Context, command []string, stdout io.Writer) error {
+	req := s.clientset.CoreV1().RESTClient().
+		Post().
+		Resource("pods").
+		Name(s.pod).
+		Namespace(s.namespace).
+		SubResource("exec").
+		VersionedParams(&v1.PodExecOptions{
+			Container: s.container,
+			Command:   command,
+			Stdout:    true,
+			Stderr:    true,
+		}, scheme.ParameterCodec)
+
+	transport, upgrader, err := spdy.RoundTripperFor(s.restConfig)
+	if err != nil {
+		return err
+	}
+	ctxTransport := &ctxRoundTripper{ctx: ctx, transport: transport, upgrader: upgrader}
+
+	executor, err := remotecommand.NewSPDYExecutorForTransports(ctxTransport, ctxTransport, "POST", req.URL())
+	if err != nil {
+		return err
+	}
+
+	var stderr bytes.Buffer
+	err = executor.Stream(remotecommand.StreamOptions{
+		Stdout: stdout,
+		Stderr: &stderr,
+	})
+	// the stream can end without an error when its connection is closed
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		if stderr.Len() > 0 {
+			return fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+		}
+		return err
+	}
+
+	return nil
+}
+
+// ctxRoundTripper dials the stream with the context, and closes its connection when the context is done,
+// since the stream doesn't support the cancellation
+type ctxRoundTripper struct {
+	ctx       context.Context
+	transport http.RoundTripper
+	upgrader  spdy.Upgrader
+}
+
+func (rt *ctxRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	return rt.transport.RoundTrip(req.WithContext(rt.ctx))
+}
+
+func (rt *ctxRoundTripper) NewConnection(resp *http.Response) (httpstream.Connection, error) {
+	conn, err := rt.upgrader.NewConnection(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		select {
+		case <-rt.ctx.Done():
+			conn.Close()
+		case <-conn.CloseChan():
+		}
+	}()
+	return conn, nil
+}
@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// ResourceTracker records the last known state of the resources touched by a command,
+// to report what was left behind when the command is interrupted.
+type ResourceTracker struct {
+	mu        sync.Mutex
+	resources []string
+	states    map[string]string
+}
+
+type resourceTrackerKey struct{}
+
+func NewResourceTracker() *ResourceTracker {
+	return &ResourceTracker{
+		states: map[string]string{},
+	}
+}
+
+// WithResourceTracker returns a context where the internal/cmd functions record the state of the resources
+func WithResourceTracker(ctx context.Context, tracker *ResourceTracker) context.Context {
+	return context.WithValue(ctx, resourceTrackerKey{}, tracker)
+}
+
+// trackResource records the state of the resource, if a tracker is in the context
+func trackResource(ctx context.Context, resource, state string) {
+	tracker, ok := ctx.Value(resourceTrackerKey{}).(*ResourceTracker)
+	if !ok {
+		return
+	}
+
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	if _, found := tracker.states[resource]; !found {
+		tracker.resources = append(tracker.resources, resource)
+	}
+	tracker.states[resource] = state
+}
+
+// Report writes the state of the tracked resources
+func (t *ResourceTracker) Report(w io.Writer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.resources) == 0 {
+		fmt.Fprintln(w, "⚠️  Interrupted before changing any resource")
+		return
+	}
+
+	fmt.Fprintln(w, "⚠️  Interrupted, the resources were left in this state:")
+	for _, resource := range t.resources {
+		fmt.Fprintf(w, "   %s: %s\n", resource, t.states[resource])
+	}
+}
@@ -5,6 +5,12 @@ import (
 	"k8s.io/client-go/kubernetes"
 )
 
+// devVersion is the version of the builds without a release version
+const devVersion = "0.0.0-dev"
+
+// Version is the version of gocoverkube, set at build time
+var Version = devVersion
+
 func ServerVersion(clientset kubernetes.Interface) (*version.Info, error) {
 	return clientset.Discovery().ServerVersion()
 }
@@ -0,0 +1,256 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	watchtools "k8s.io/client-go/tools/watch"
+)
+
+type waitTimeoutKey struct{}
+
+// waitBudget is the time left to the waits of a command
+type waitBudget struct {
+	timeout  time.Duration
+	deadline time.Time
+}
+
+// WithWaitTimeout returns a context setting the maximum duration of the waits for the resources from now on:
+// they share the timeout, that is not renewed by each of them. A zero timeout waits forever.
+func WithWaitTimeout(ctx context.Context, timeout time.Duration) context.Context {
+	budget := waitBudget{timeout: timeout}
+	if timeout > 0 {
+		budget.deadline = time.Now().Add(timeout)
+	}
+	return context.WithValue(ctx, waitTimeoutKey{}, budget)
+}
+
+func waitBudgetFrom(ctx context.Context) waitBudget {
+	budget, _ := ctx.Value(waitTimeoutKey{}).(waitBudget)
+	return budget
+}
+
+// errWaitTimeout is returned when a wait does not complete within the configured timeout
+type errWaitTimeout struct {
+	timeout time.Duration
+}
+
+func (e *errWaitTimeout) Error() string {
+	return fmt.Sprintf("timed out after %v", e.timeout)
+}
+
+// waitResyncPeriod is the interval of the evaluations of the condition without changes, for the conditions depending on the time
+var waitResyncPeriod = 10 * time.Second
+
+// conditionFunc is evaluated on all the watched objects every time one of them changes, and periodically
+type conditionFunc func(objs []runtime.Object) (bool, error)
+
+// waitFor watches the objects returned by the ListerWatcher until the condition is true or the context is done.
+// The condition is evaluated on the current state first, so it returns immediately if it is already satisfied.
+func waitFor(ctx context.Context, lw cache.ListerWatcher, objType runtime.Object, condition conditionFunc) error {
+	parentCtx := ctx
+
+	budget := waitBudgetFrom(ctx)
+	if !budget.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, budget.deadline)
+		defer cancel()
+	}
+
+	// the condition is evaluated by the watch and by the resync
+	var mu sync.Mutex
+	var store cache.Store
+	iteration := 0
+
+	evaluate := func() (bool, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		objs := []runtime.Object{}
+		for _, obj := range store.List() {
+			objs = append(objs, obj.(runtime.Object))
+		}
+
+		done, err := condition(objs)
+		iteration++
+		logger(ctx).Debug("wait iteration",
+			"type", fmt.Sprintf("%T", objType), "iteration", iteration, "objects", len(objs), "done", done, "error", err)
+		return done, err
+	}
+
+	// the resync stops the watch when the condition is satisfied without changes, i.e. a grace period expired
+	watchCtx, stopWatch := context.WithCancel(ctx)
+	defer stopWatch()
+	synced := make(chan struct{})
+	resynced := make(chan error, 1)
+	resyncDone := make(chan struct{})
+	go func() {
+		defer close(resyncDone)
+
+		select {
+		case <-watchCtx.Done():
+			return
+		case <-synced:
+		}
+
+		ticker := time.NewTicker(waitResyncPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-watchCtx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			done, err := evaluate()
+			if done || err != nil {
+				resynced <- err
+				stopWatch()
+				return
+			}
+		}
+	}()
+
+	_, err := watchtools.UntilWithSync(
+		watchCtx,
+		lw,
+		objType,
+		func(s cache.Store) (bool, error) {
+			mu.Lock()
+			store = s
+			mu.Unlock()
+			close(synced)
+			return evaluate()
+		},
+		func(watch.Event) (bool, error) {
+			return evaluate()
+		},
+	)
+
+	// the condition is not evaluated anymore once returned
+	stopWatch()
+	<-resyncDone
+
+	select {
+	case resyncErr := <-resynced:
+		return resyncErr
+	default:
+	}
+
+	if err != nil && ctx.Err() != nil && errors.Is(err, wait.ErrWaitTimeout) {
+		// the parent context was cancelled, the timeout did not expire
+		if parentCtx.Err() != nil {
+			return parentCtx.Err()
+		}
+		return &errWaitTimeout{timeout: budget.timeout}
+	}
+	return err
+}
+
+// waitForPods waits until the condition on the pods matching the list options is true
+func waitForPods(
+	ctx context.Context,
+	clientset kubernetes.Interface,
+	namespace string,
+	listOptions metav1.ListOptions,
+	condition func(pods []*v1.Pod) (bool, error),
+) error {
+	podClient := clientset.CoreV1().Pods(namespace)
+
+	lw := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.LabelSelector = listOptions.LabelSelector
+			options.FieldSelector = listOptions.FieldSelector
+			return podClient.List(ctx, options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.LabelSelector = listOptions.LabelSelector
+			options.FieldSelector = listOptions.FieldSelector
+			return podClient.Watch(ctx, options)
+		},
+	}
+
+	var lastPods []*v1.Pod
+	states := &podStateLogger{}
+
+	err := waitFor(ctx, lw, &v1.Pod{}, func(objs []runtime.Object) (bool, error) {
+		pods := []*v1.Pod{}
+		for _, obj := range objs {
+			pods = append(pods, obj.(*v1.Pod))
+		}
+		lastPods = pods
+		states.Log(ctx, pods)
+		return condition(pods)
+	})
+
+	if err == nil || ctx.Err() != nil {
+		return err
+	}
+
+	// attach the events and the logs of the pods that are not ready, to explain the failure
+	return fmt.Errorf("%w%s", err, diagnosePods(ctx, clientset, namespace, lastPods))
+}
+
+// waitForPod waits until the condition on the named pod is true. The condition receives nil if the pod does not exist.
+func waitForPod(
+	ctx context.Context,
+	clientset kubernetes.Interface,
+	namespace, name string,
+	condition func(pod *v1.Pod) (bool, error),
+) error {
+	listOptions := metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("metadata.name", name).String(),
+	}
+
+	err := waitForPods(ctx, clientset, namespace, listOptions, func(pods []*v1.Pod) (bool, error) {
+		if len(pods) == 0 {
+			return condition(nil)
+		}
+		return condition(pods[0])
+	})
+	if err != nil && ctx.Err() == nil {
+		return fmt.Errorf("waiting for pod '%s': %w", name, err)
+	}
+	return err
+}
+
+func podDeleted(pod *v1.Pod) (bool, error) {
+	return pod == nil, nil
+}
+
+// podRunning returns true when the pod is running, or an error if it will never be
+func podRunning(pod *v1.Pod) (bool, error) {
+	if pod == nil {
+		return false, nil
+	}
+	if err := podFailure(pod); err != nil {
+		return false, err
+	}
+	return pod.Status.Phase == v1.PodRunning, nil
+}
+
+// podReady returns true when the pod is running and all its containers are ready, or an error if it will never be
+func podReady(pod *v1.Pod) (bool, error) {
+	running, err := podRunning(pod)
+	if !running {
+		return false, err
+	}
+
+	for _, c := range pod.Status.Conditions {
+		if c.Type == v1.PodReady {
+			return c.Status == v1.ConditionTrue, nil
+		}
+	}
+	return false, nil
+}
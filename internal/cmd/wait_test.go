@@ -0,0 +1,127 @@
+package cmd
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestWaitForPodUnboundClaim(t *testing.T) {
+	resyncPeriod := waitResyncPeriod
+	waitResyncPeriod = 50 * time.Millisecond
+	t.Cleanup(func() { waitResyncPeriod = resyncPeriod })
+
+	tests := []struct {
+		name string
+		// since is how long the pod has been unschedulable
+		since   time.Duration
+		wantErr string
+	}{
+		{
+			name:    "grace period expired",
+			since:   2 * unboundClaimGracePeriod,
+			wantErr: "PersistentVolumeClaims are not bound",
+		},
+		{
+			name:    "grace period expiring without changes",
+			since:   unboundClaimGracePeriod - 200*time.Millisecond,
+			wantErr: "PersistentVolumeClaims are not bound",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := &v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "ns"},
+				Status: v1.PodStatus{
+					Phase: v1.PodPending,
+					Conditions: []v1.PodCondition{{
+						Type:               v1.PodScheduled,
+						Status:             v1.ConditionFalse,
+						Reason:             v1.PodReasonUnschedulable,
+						Message:            "0/1 nodes are available: pod has unbound immediate PersistentVolumeClaims.",
+						LastTransitionTime: metav1.NewTime(time.Now().Add(-tt.since)),
+					}},
+				},
+			}
+			clientset := fake.NewSimpleClientset(pod)
+
+			// the pod never changes, without the resync the wait would last until the test timeout
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			err := waitForPod(WithWaitTimeout(ctx, 0), clientset, "ns", "app", podRunning)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+			if ctx.Err() != nil {
+				t.Fatalf("the wait ended with the test timeout")
+			}
+		})
+	}
+}
+
+func TestPodFailure(t *testing.T) {
+	waiting := func(reason string) *v1.Pod {
+		return &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "app"},
+			Status: v1.PodStatus{
+				Phase: v1.PodPending,
+				ContainerStatuses: []v1.ContainerStatus{{
+					Name:  "app",
+					State: v1.ContainerState{Waiting: &v1.ContainerStateWaiting{Reason: reason}},
+				}},
+			},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		pod     *v1.Pod
+		wantErr string
+	}{
+		{
+			name: "image pull retried",
+			pod:  waiting("ErrImagePull"),
+		},
+		{
+			name:    "image pull backing off",
+			pod:     waiting("ImagePullBackOff"),
+			wantErr: "is in ImagePullBackOff",
+		},
+		{
+			name:    "invalid image",
+			pod:     waiting("InvalidImageName"),
+			wantErr: "is in InvalidImageName",
+		},
+		{
+			name: "container creating",
+			pod:  waiting("ContainerCreating"),
+		},
+		{
+			name:    "failed pod",
+			pod:     &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "app"}, Status: v1.PodStatus{Phase: v1.PodFailed, Reason: "Evicted"}},
+			wantErr: "failed: Evicted",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := podFailure(tt.pod)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
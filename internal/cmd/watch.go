@@ -0,0 +1,116 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	watchRawDir    = "raw"
+	watchMergedDir = "merged"
+)
+
+// CollectFunc collects the coverage files into the outDst directory
+type CollectFunc func(ctx context.Context, outDst string) error
+
+// Watch collects the coverage every interval, merging it and printing the coverage percentage,
+// until the context is cancelled. The raw files are collected in the 'raw' subdirectory of outDst,
+// and the merged result in the 'merged' one, with the profile mapped to the local sources.
+func Watch(ctx context.Context, outDst string, interval time.Duration, pathMap PathMapOptions, collect CollectFunc) error {
+	err := checkGoToolchain()
+	if err != nil {
+		return err
+	}
+
+	mapper, err := newPathMapper(ctx, pathMap)
+	if err != nil {
+		return err
+	}
+
+	rawDir := filepath.Join(outDst, watchRawDir)
+	err = os.MkdirAll(rawDir, os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	lastPercent := -1.0
+	for cycle := 1; ; cycle++ {
+		report(ctx, Event{Action: "collect"}, "🔁 Collection #%d", cycle)
+
+		err := collect(ctx, rawDir)
+		if err != nil && ctx.Err() == nil {
+			return err
+		}
+
+		// the final merge is done even if the collection was interrupted
+		percent, mergeErr := mergeAndReport(context.WithoutCancel(ctx), outDst, rawDir, mapper)
+		if mergeErr != nil {
+			return mergeErr
+		}
+
+		switch {
+		case ctx.Err() != nil:
+			printFinalCoverage(ctx, outDst, percent, mapper)
+			return nil
+		case lastPercent < 0:
+			report(ctx, Event{Action: "merge"}, "📈 Coverage %.1f%%", percent)
+		default:
+			report(ctx, Event{Action: "merge"}, "📈 Coverage %.1f%% (%+.1f%%)", percent, percent-lastPercent)
+		}
+		lastPercent = percent
+
+		report(ctx, Event{Action: "wait"}, "⏳ Next collection in %v, press Ctrl-C to stop", interval)
+
+		select {
+		case <-ctx.Done():
+			printFinalCoverage(ctx, outDst, percent, mapper)
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// mergeAndReport merges the raw coverage files and returns the coverage percentage
+func mergeAndReport(ctx context.Context, outDst, rawDir string, mapper *pathMapper) (float64, error) {
+	files, err := os.ReadDir(rawDir)
+	if err != nil {
+		return 0, err
+	}
+
+	paths := []string{}
+	for _, f := range files {
+		paths = append(paths, f.Name())
+	}
+	// nothing to merge yet, the counters are written when the process exits
+	if countPaths(paths, covMetaPrefix) == 0 || countPaths(paths, covCountersPrefix) == 0 {
+		return 0, nil
+	}
+
+	mergedDir := filepath.Join(outDst, watchMergedDir)
+	err = mergeCoverage(ctx, mergedDir, rawDir)
+	if err != nil {
+		return 0, err
+	}
+
+	profile := filepath.Join(outDst, profileFile)
+	err = textProfile(ctx, mergedDir, profile, mapper)
+	if err != nil {
+		return 0, err
+	}
+
+	return profilePercent(profile)
+}
+
+func printFinalCoverage(ctx context.Context, outDst string, percent float64, mapper *pathMapper) {
+	mapper.warnUnresolved(ctx)
+
+	mergedDir := filepath.Join(outDst, watchMergedDir)
+	report(ctx, Event{Action: "merge"}, "🏁 Final coverage %.1f%%, merged at '%s'", percent, mergedDir)
+	setResult(ctx, "coveragePercent", percent)
+	setResult(ctx, "mergedDir", mergedDir)
+}
@@ -0,0 +1,125 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// memSource is a fileSource with the files in memory
+type memSource map[string][]byte
+
+func (s memSource) List(ctx context.Context) ([]remoteFile, error) {
+	files := []remoteFile{}
+	for name, content := range s {
+		sum := sha256.Sum256(content)
+		files = append(files, remoteFile{path: name, size: int64(len(content)), checksum: hex.EncodeToString(sum[:])})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].path < files[j].path })
+	return files, nil
+}
+
+func (s memSource) Open(ctx context.Context, name string, offset int64, compress bool) (io.ReadCloser, error) {
+	content, found := s[name]
+	if !found {
+		return nil, os.ErrNotExist
+	}
+	return io.NopCloser(bytes.NewReader(content[offset:])), nil
+}
+
+func (s memSource) Delete(ctx context.Context, name string) error {
+	delete(s, name)
+	return nil
+}
+
+func (s memSource) Archive(ctx context.Context) (io.ReadCloser, error) {
+	return nil, errors.New("not supported")
+}
+
+func (s memSource) Close() error {
+	return nil
+}
+
+func TestCopyWithoutCounters(t *testing.T) {
+	tests := []struct {
+		name        string
+		incremental bool
+		wantErr     string
+	}{
+		{
+			name:    "full collection",
+			wantErr: "no coverage counters found",
+		},
+		{
+			name:        "incremental collection",
+			incremental: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dst := t.TempDir()
+			source := memSource{"covmeta.1": []byte("meta")}
+
+			err := NewCopier(source, CopyOptions{Incremental: tt.incremental}).Copy(context.Background(), dst)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if _, err := os.Stat(filepath.Join(dst, "covmeta.1")); err != nil {
+				t.Errorf("meta-data not copied: %v", err)
+			}
+		})
+	}
+}
+
+func TestWatchWithoutCounters(t *testing.T) {
+	if checkGoToolchain() != nil {
+		t.Skip("go toolchain not found")
+	}
+
+	outDst := t.TempDir()
+	source := memSource{"covmeta.1": []byte("meta")}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cycles := 0
+	err := Watch(ctx, outDst, time.Hour, PathMapOptions{}, func(ctx context.Context, dst string) error {
+		cycles++
+		err := NewCopier(source, CopyOptions{Incremental: true}).Copy(ctx, dst)
+		if err == nil {
+			// the watch is interrupted after the first collection
+			cancel()
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cycles != 1 {
+		t.Errorf("got %d cycles, want 1", cycles)
+	}
+
+	if _, err := os.Stat(filepath.Join(outDst, watchRawDir, "covmeta.1")); err != nil {
+		t.Errorf("meta-data not collected: %v", err)
+	}
+	// there are no counters to merge yet
+	if _, err := os.Stat(filepath.Join(outDst, watchMergedDir)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected no merged data, got %v", err)
+	}
+}
@@ -0,0 +1,107 @@
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Client talks with the collector Server
+type Client struct {
+	baseURL    string
+	token      string
+	httpClient *http.Client
+}
+
+func NewClient(baseURL, token string) *Client {
+	return &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		token:      token,
+		httpClient: &http.Client{},
+	}
+}
+
+// List returns the files of the coverage directory
+func (c *Client) List(ctx context.Context) ([]File, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/files", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	files := []File{}
+	err = json.NewDecoder(resp.Body).Decode(&files)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding files list: %w", err)
+	}
+
+	return files, nil
+}
+
+// Open returns the content of the file starting from offset.
+// If compress is true the content is returned gzipped.
+func (c *Client) Open(ctx context.Context, name string, offset int64, compress bool) (io.ReadCloser, error) {
+	header := http.Header{}
+	if offset > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	// setting the header explicitly disables the transparent decompression of the http.Transport
+	if compress {
+		header.Set("Accept-Encoding", "gzip")
+	}
+
+	resp, err := c.do(ctx, http.MethodGet, "/files/"+url.PathEscape(name), header)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+// Delete removes the file from the coverage directory
+func (c *Client) Delete(ctx context.Context, name string) error {
+	resp, err := c.do(ctx, http.MethodDelete, "/files/"+url.PathEscape(name), nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Archive returns a tar.gz archive of the coverage directory
+func (c *Client) Archive(ctx context.Context) (io.ReadCloser, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/archive", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+func (c *Client) do(ctx context.Context, method, path string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,298 @@
+package collector
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TokenEnvVar = "GOCOVERKUBE_TOKEN"
+	Port        = 8080
+)
+
+// File is a file of the coverage directory
+type File struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	SHA256  string    `json:"sha256"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// Server serves the files of the coverage directory
+type Server struct {
+	dir   string
+	token string
+
+	mu        sync.Mutex
+	checksums map[string]cachedChecksum
+}
+
+type cachedChecksum struct {
+	size    int64
+	modTime time.Time
+	sha256  string
+}
+
+func NewServer(dir, token string) *Server {
+	return &Server{
+		dir:       dir,
+		token:     token,
+		checksums: map[string]cachedChecksum{},
+	}
+}
+
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	})
+	mux.Handle("/files", s.authenticated(http.HandlerFunc(s.handleList)))
+	mux.Handle("/files/", s.authenticated(http.HandlerFunc(s.handleFile)))
+	mux.Handle("/archive", s.authenticated(http.HandlerFunc(s.handleArchive)))
+	return mux
+}
+
+func (s *Server) authenticated(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) handleList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	files, err := s.list()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(files)
+}
+
+func (s *Server) handleFile(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/files/")
+	if !filepath.IsLocal(name) {
+		http.Error(w, "invalid file name", http.StatusBadRequest)
+		return
+	}
+	path := filepath.Join(s.dir, name)
+
+	switch r.Method {
+	case http.MethodGet:
+		s.serveFile(w, r, path)
+
+	case http.MethodDelete:
+		err := os.Remove(path)
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// serveFile serves the file content. Only the 'bytes=N-' range is supported, to resume the downloads,
+// and the content is gzipped if requested, since the size of the compressed content is not known in advance.
+func (s *Server) serveFile(w http.ResponseWriter, r *http.Request, path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	defer f.Close()
+
+	status := http.StatusOK
+
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+		offset, err := parseRangeOffset(rangeHeader)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+
+		_, err = f.Seek(offset, io.SeekStart)
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		status = http.StatusPartialContent
+	}
+
+	var out io.Writer = w
+	if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		defer gz.Close()
+		out = gz
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(status)
+	_, _ = io.Copy(out, f)
+}
+
+func (s *Server) handleArchive(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	files, err := s.list()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+
+	gz := gzip.NewWriter(w)
+	defer gz.Close()
+	tw := tar.NewWriter(gz)
+	defer tw.Close()
+
+	for _, file := range files {
+		err := addToArchive(tw, filepath.Join(s.dir, file.Name), file)
+		if err != nil {
+			// headers are already sent, the client will fail reading the truncated archive
+			return
+		}
+	}
+}
+
+func addToArchive(tw *tar.Writer, path string, file File) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	err = tw.WriteHeader(&tar.Header{
+		Name:    file.Name,
+		Mode:    0o644,
+		Size:    file.Size,
+		ModTime: file.ModTime,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.CopyN(tw, f, file.Size)
+	return err
+}
+
+func (s *Server) list() ([]File, error) {
+	files := []File{}
+
+	err := filepath.WalkDir(s.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		name, err := filepath.Rel(s.dir, path)
+		if err != nil {
+			return err
+		}
+
+		checksum, err := s.checksum(path, info)
+		if err != nil {
+			return err
+		}
+
+		files = append(files, File{
+			Name:    filepath.ToSlash(name),
+			Size:    info.Size(),
+			SHA256:  checksum,
+			ModTime: info.ModTime(),
+		})
+		return nil
+	})
+
+	return files, err
+}
+
+// checksum returns the sha256 of the file, cached until its size or modification time change
+func (s *Server) checksum(path string, info fs.FileInfo) (string, error) {
+	s.mu.Lock()
+	cached, found := s.checksums[path]
+	s.mu.Unlock()
+
+	if found && cached.size == info.Size() && cached.modTime.Equal(info.ModTime()) {
+		return cached.sha256, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	checksum := hex.EncodeToString(h.Sum(nil))
+
+	s.mu.Lock()
+	s.checksums[path] = cachedChecksum{size: info.Size(), modTime: info.ModTime(), sha256: checksum}
+	s.mu.Unlock()
+
+	return checksum, nil
+}
+
+func parseRangeOffset(rangeHeader string) (int64, error) {
+	spec, found := strings.CutPrefix(rangeHeader, "bytes=")
+	if !found || !strings.HasSuffix(spec, "-") {
+		return 0, fmt.Errorf("unsupported range '%s'", rangeHeader)
+	}
+
+	offset, err := strconv.ParseInt(strings.TrimSuffix(spec, "-"), 10, 64)
+	if err != nil || offset < 0 {
+		return 0, fmt.Errorf("invalid range '%s'", rangeHeader)
+	}
+
+	return offset, nil
+}
+
+func httpError(w http.ResponseWriter, err error) {
+	if errors.Is(err, fs.ErrNotExist) {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
@@ -0,0 +1,400 @@
+package collector
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testToken = "secret-token"
+
+// testFiles are the files of the coverage directory of the tests
+var testFiles = map[string]string{
+	"covmeta.1":             "meta-data",
+	"sub/covcounters.1.1.1": "counters",
+}
+
+// newTestServer serves a coverage directory with the test files, next to a file outside of it
+func newTestServer(t *testing.T) (*httptest.Server, string) {
+	t.Helper()
+
+	root := t.TempDir()
+	dir := filepath.Join(root, "coverage")
+	for name, content := range testFiles {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(root, "outside"), []byte("outside"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(NewServer(dir, testToken).Handler())
+	t.Cleanup(srv.Close)
+	return srv, dir
+}
+
+func TestHealthz(t *testing.T) {
+	srv, _ := newTestServer(t)
+
+	resp, err := http.Get(srv.URL + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode != http.StatusOK || string(body) != "ok" {
+		t.Errorf("got %d %q, want 200 \"ok\"", resp.StatusCode, body)
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	srv, _ := newTestServer(t)
+
+	tests := []struct {
+		name          string
+		path          string
+		authorization string
+		wantStatus    int
+	}{
+		{
+			name:       "missing token",
+			path:       "/files",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:          "wrong token",
+			path:          "/files",
+			authorization: "Bearer wrong",
+			wantStatus:    http.StatusUnauthorized,
+		},
+		{
+			name:          "token prefix",
+			path:          "/files",
+			authorization: "Bearer " + testToken[:3],
+			wantStatus:    http.StatusUnauthorized,
+		},
+		{
+			name:          "missing token on a file",
+			path:          "/files/covmeta.1",
+			authorization: "",
+			wantStatus:    http.StatusUnauthorized,
+		},
+		{
+			name:          "missing token on the archive",
+			path:          "/archive",
+			authorization: "Bearer ",
+			wantStatus:    http.StatusUnauthorized,
+		},
+		{
+			name:          "valid token",
+			path:          "/files",
+			authorization: "Bearer " + testToken,
+			wantStatus:    http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, srv.URL+tt.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("got status %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestList(t *testing.T) {
+	srv, _ := newTestServer(t)
+
+	files, err := NewClient(srv.URL, testToken).List(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	got := map[string]File{}
+	for _, f := range files {
+		got[f.Name] = f
+	}
+	for name, content := range testFiles {
+		sum := sha256.Sum256([]byte(content))
+		f, found := got[name]
+		if !found {
+			t.Errorf("file %q not listed", name)
+			continue
+		}
+		if f.Size != int64(len(content)) || f.SHA256 != hex.EncodeToString(sum[:]) {
+			t.Errorf("file %q: got size %d and sha256 %s", name, f.Size, f.SHA256)
+		}
+	}
+	if len(got) != len(testFiles) {
+		t.Errorf("got %d files, want %d", len(got), len(testFiles))
+	}
+}
+
+func TestOpen(t *testing.T) {
+	srv, _ := newTestServer(t)
+	client := NewClient(srv.URL, testToken)
+
+	tests := []struct {
+		name     string
+		file     string
+		offset   int64
+		compress bool
+		want     string
+		wantErr  string
+	}{
+		{
+			name: "whole file",
+			file: "covmeta.1",
+			want: "meta-data",
+		},
+		{
+			name:   "resumed from the offset",
+			file:   "covmeta.1",
+			offset: 5,
+			want:   "data",
+		},
+		{
+			name:     "gzipped",
+			file:     "sub/covcounters.1.1.1",
+			compress: true,
+			want:     "counters",
+		},
+		{
+			name:     "gzipped from the offset",
+			file:     "sub/covcounters.1.1.1",
+			offset:   5,
+			compress: true,
+			want:     "ers",
+		},
+		{
+			name:    "missing file",
+			file:    "covmeta.2",
+			wantErr: "404",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content, err := client.Open(context.Background(), tt.file, tt.offset, tt.compress)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer content.Close()
+
+			var r io.Reader = content
+			if tt.compress {
+				gz, err := gzip.NewReader(content)
+				if err != nil {
+					t.Fatalf("content not gzipped: %v", err)
+				}
+				defer gz.Close()
+				r = gz
+			}
+
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInvalidRange(t *testing.T) {
+	srv, _ := newTestServer(t)
+
+	for _, rangeHeader := range []string{"bytes=0-4", "bytes=-4", "bytes=x-", "lines=1-"} {
+		t.Run(rangeHeader, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, srv.URL+"/files/covmeta.1", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Authorization", "Bearer "+testToken)
+			req.Header.Set("Range", rangeHeader)
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+				t.Errorf("got status %d, want %d", resp.StatusCode, http.StatusRequestedRangeNotSatisfiable)
+			}
+		})
+	}
+}
+
+func TestFileNames(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		path   string
+	}{
+		{
+			name:   "get parent",
+			method: http.MethodGet,
+			path:   "/files/../outside",
+		},
+		{
+			name:   "delete parent",
+			method: http.MethodDelete,
+			path:   "/files/../outside",
+		},
+		{
+			name:   "get nested parent",
+			method: http.MethodGet,
+			path:   "/files/sub/../../outside",
+		},
+		{
+			name:   "delete absolute",
+			method: http.MethodDelete,
+			path:   "/files//outside",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			dir := filepath.Join(root, "coverage")
+			if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+				t.Fatal(err)
+			}
+			outside := filepath.Join(root, "outside")
+			if err := os.WriteFile(outside, []byte("outside"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			// the handler of the files is called directly, the mux would redirect to the cleaned path
+			s := NewServer(dir, testToken)
+			req := httptest.NewRequest(tt.method, "/", nil)
+			req.URL.Path = tt.path
+			rec := httptest.NewRecorder()
+			s.handleFile(rec, req)
+
+			if rec.Code != http.StatusBadRequest {
+				t.Errorf("got status %d, want %d", rec.Code, http.StatusBadRequest)
+			}
+			if strings.Contains(rec.Body.String(), "outside") && !strings.Contains(rec.Body.String(), "invalid") {
+				t.Errorf("file outside of the directory served: %q", rec.Body.String())
+			}
+			if _, err := os.Stat(outside); err != nil {
+				t.Errorf("file outside of the directory deleted: %v", err)
+			}
+		})
+	}
+}
+
+func TestFileNamesThroughClient(t *testing.T) {
+	srv, dir := newTestServer(t)
+	client := NewClient(srv.URL, testToken)
+	outside := filepath.Join(filepath.Dir(dir), "outside")
+
+	content, err := client.Open(context.Background(), "../outside", 0, false)
+	if err == nil {
+		got, _ := io.ReadAll(content)
+		content.Close()
+		t.Errorf("file outside of the directory served: %q", got)
+	}
+
+	err = client.Delete(context.Background(), "../outside")
+	if err == nil {
+		t.Errorf("expected an error deleting a file outside of the directory")
+	}
+	if _, err := os.Stat(outside); err != nil {
+		t.Errorf("file outside of the directory deleted: %v", err)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	srv, dir := newTestServer(t)
+	client := NewClient(srv.URL, testToken)
+
+	err := client.Delete(context.Background(), "sub/covcounters.1.1.1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "sub", "covcounters.1.1.1")); !os.IsNotExist(err) {
+		t.Errorf("file not deleted: %v", err)
+	}
+
+	err = client.Delete(context.Background(), "sub/covcounters.1.1.1")
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("expected a not found error, got %v", err)
+	}
+}
+
+func TestArchive(t *testing.T) {
+	srv, _ := newTestServer(t)
+
+	archive, err := NewClient(srv.URL, testToken).Archive(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer archive.Close()
+
+	gz, err := gzip.NewReader(archive)
+	if err != nil {
+		t.Fatalf("archive not gzipped: %v", err)
+	}
+	defer gz.Close()
+
+	got := map[string]string{}
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("invalid archive: %v", err)
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("invalid archive: %v", err)
+		}
+		got[header.Name] = string(content)
+	}
+
+	if !reflect.DeepEqual(got, testFiles) {
+		t.Errorf("got %v, want %v", got, testFiles)
+	}
+}
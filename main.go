@@ -1,15 +1,26 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/enrichman/gocoverkube/internal/cli"
 )
 
 func main() {
-	rootCmd := cli.NewRootCmd()
-	if err := rootCmd.Execute(); err != nil {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// after the first interrupt the default behavior is restored, so that a second one exits also during the rollback
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	if err := cli.Execute(ctx); err != nil {
 		fmt.Fprintf(os.Stderr, "❌ error: %s\n", err)
 		os.Exit(100)
 	}